@@ -15,16 +15,83 @@ var showAllCmd = &cobra.Command{
 			cmd.Help()
 			return
 		}
+		if !textOutput() {
+			showAll(args)
+			return
+		}
 		showCommentCmd.Run(cmd, args)
+		if cur, err := tager.getTag(args[0]); err == nil && cur.HasChild("attrs") {
+			fmt.Println()
+			fmt.Println("attrs:")
+			showAttrs(attrsOf(cur))
+		}
 		fmt.Println()
 		fmt.Println("tags:")
 		showTagsCmd.Run(cmd, args)
 		fmt.Println()
 		fmt.Println("files:")
 		showFilesCmd.Run(cmd, args)
+		showFileAttrs(args)
 	},
 }
 
+// 属性を持つファイルのみ表示する
+func showFileAttrs(args []string) {
+	files, err := tager.getFilesQuery(*showFlagR, args...)
+	if err != nil {
+		return
+	}
+	shown := false
+	for _, file := range files {
+		attrs := tager.fileAttrsString(file)
+		if attrs == "" {
+			continue
+		}
+		if !shown {
+			fmt.Println()
+			fmt.Println("file attrs:")
+			shown = true
+		}
+		fmt.Println(file+":", attrs)
+	}
+}
+
+// kind(comment, attr, tag, file), value, attrs(ファイルの属性)
+func showAll(args []string) {
+	cur, err := tager.getTag(args[0])
+	if err != nil {
+		outputFatal(err)
+		return
+	}
+	tags, err := tager.getChildTags(args[0], *showFlagR)
+	if err != nil {
+		outputFatal(err)
+		return
+	}
+	files, err := tager.getFilesQuery(*showFlagR, args...)
+	if err != nil {
+		outputFatal(err)
+		return
+	}
+	table := newTable(1, "kind", "value", "attrs")
+	if cur.HasChild("comment") {
+		table.add("comment", cur.Child("comment").ToString(), "")
+	}
+	attrs := attrsOf(cur)
+	for _, key := range sortedKeys(attrs) {
+		table.add("attr", key+"="+attrs[key], "")
+	}
+	for _, tag := range tags {
+		table.add("tag", tag, "")
+	}
+	for _, file := range files {
+		table.add("file", file, tager.fileAttrsString(file))
+	}
+	if err := table.print(); err != nil {
+		outputFatal(err)
+	}
+}
+
 var autoremoveAllCmd = &cobra.Command{
 	Use:   "all [TAG...]",
 	Short: "タグから存在しないタグとファイルを自動削除する",
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intelfike/nestmap"
+	"github.com/spf13/cobra"
+)
+
+// ファイルとタグの属性
+//
+//	root.files.<file>.attrs.<key>
+//	root.tags.<tag>.attrs.<key>
+//
+// 値は文字列として保存し、比較するときに数値、日付、真偽値、文字列の順に型を判定する
+
+var setCmd = &cobra.Command{
+	Use:   "set [flags] FILE KEY=VALUE...",
+	Short: "ファイルやタグに属性を設定する",
+	Long: `ファイルやタグに属性を設定する
+値の型は自動で判定されます
+  数値    2, 0.5
+  日付    2026-10-01, 2026-10-01T12:00:00+09:00
+  真偽値  true, false
+  文字列  それ以外
+--tag を指定した場合は、FILE の代わりにタグ名を指定します
+ファイルはタグに登録されている必要があり、どのタグにも登録されなくなると属性も削除されます
+属性は show file の論理式で比較することができます(tager show file -h を参照)
+例: tager set main.go owner=alice priority=2 reviewed=2026-10-01
+    tager set --tag backend color=blue`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) <= 1 {
+			cmd.Help()
+			return
+		}
+		cur, err := tager.attrTarget(args[0], *setFlagTag)
+		if err != nil {
+			outputFatal(err)
+		}
+		// 1つでも誤りがあれば、何も設定せずに終了する
+		attrs := make([][2]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			key, value, err := parseAttr(arg)
+			if err != nil {
+				outputFatal(err)
+			}
+			attrs = append(attrs, [2]string{key, value})
+		}
+		for _, kv := range attrs {
+			cur.Child("attrs", kv[0]).Set(kv[1])
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var unsetCmd = &cobra.Command{
+	Use:   "unset [flags] FILE KEY...",
+	Short: "ファイルやタグから属性を削除する",
+	Long:  "ファイルやタグから属性を削除する\n--tag を指定した場合は、FILE の代わりにタグ名を指定します",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) <= 1 {
+			cmd.Help()
+			return
+		}
+		cur, err := tager.attrTarget(args[0], *unsetFlagTag)
+		if err != nil {
+			outputFatal(err)
+		}
+		for _, key := range args[1:] {
+			if !cur.HasChild("attrs") || !cur.Child("attrs").HasChild(key) {
+				outputError(key, "という属性はありません")
+				continue
+			}
+			cur.Child("attrs", key).Remove()
+		}
+		if cur.HasChild("attrs") && len(cur.Child("attrs").Keys()) == 0 {
+			cur.Child("attrs").Remove()
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var showAttrCmd = &cobra.Command{
+	Use:   "attr [flags] FILE...",
+	Short: "ファイルやタグの属性を表示する",
+	Long:  "ファイルやタグの属性を表示する\n--tag を指定した場合は、FILE の代わりにタグ名を指定します",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			return
+		}
+		table := newTable(2, "target", "key", "value", "type")
+		for n, arg := range args {
+			cur, err := tager.attrTarget(arg, *showAttrFlagTag)
+			if err != nil {
+				outputError(err)
+				continue
+			}
+			attrs := attrsOf(cur)
+			if !textOutput() {
+				for _, key := range sortedKeys(attrs) {
+					table.add(arg, key, attrs[key], attrType(attrs[key]))
+				}
+				continue
+			}
+			if len(args) != 1 {
+				if n != 0 {
+					fmt.Println()
+				}
+				fmt.Println(arg + ":")
+			}
+			showAttrs(attrs)
+		}
+		if !textOutput() {
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+		}
+	},
+}
+
+func showAttrs(attrs map[string]string) {
+	for _, key := range sortedKeys(attrs) {
+		fmt.Println(key + "=" + attrs[key])
+	}
+}
+
+// 属性を持つノード
+// ファイルの場合は存在し、タグに登録されている必要がある
+// (ファイルの情報は、どのタグにも登録されなくなったときに属性ごと削除される)
+func (t *Tager) attrTarget(arg string, isTag bool) (*nestmap.Nestmap, error) {
+	if isTag {
+		return t.getTag(arg)
+	}
+	if !fileExists(arg) {
+		return nil, errors.New(arg + " そのようなファイルは存在しません")
+	}
+	full, err := filepath.Abs(arg)
+	if err != nil {
+		return nil, errors.New(arg + " ファイル名の指定が正しくありません")
+	}
+	if !t.isRegistered(full) {
+		return nil, errors.New(arg + " はどのタグにも登録されていません(tager add file を参照)")
+	}
+	return t.fileMeta(full), nil
+}
+
+// ファイルの属性を key=value の形式で並べる
+func (t *Tager) fileAttrsString(full string) string {
+	attrs := attrsOf(t.fileMeta(full))
+	ss := make([]string, 0, len(attrs))
+	for _, key := range sortedKeys(attrs) {
+		ss = append(ss, key+"="+attrs[key])
+	}
+	return strings.Join(ss, " ")
+}
+
+func attrsOf(cur *nestmap.Nestmap) map[string]string {
+	attrs := map[string]string{}
+	if !cur.Exists() || !cur.HasChild("attrs") {
+		return attrs
+	}
+	for _, key := range cur.Child("attrs").Keys() {
+		attrs[key] = cur.Child("attrs", key).ToString()
+	}
+	return attrs
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// KEY=VALUE
+func parseAttr(arg string) (key, value string, err error) {
+	n := strings.Index(arg, "=")
+	if n == -1 {
+		return "", "", errors.New(arg + " KEY=VALUE の形式で指定してください")
+	}
+	key, value = arg[:n], arg[n+1:]
+	if err := checkAttrKey(key); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// 論理式で使えない文字は属性名に含められない
+func checkAttrKey(key string) error {
+	if key == "" {
+		return errors.New("属性名が空です")
+	}
+	if strings.ContainsAny(key, "=<>!&|() \t") {
+		return errors.New(key + " :属性名に = < > ! & | ( ) と空白は使えません")
+	}
+	return nil
+}
+
+// ==================== 比較 ====================
+
+var attrDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+func parseAttrDate(v string) (time.Time, bool) {
+	for _, layout := range attrDateLayouts {
+		if at, err := time.Parse(layout, v); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func attrType(v string) string {
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return "number"
+	}
+	if _, ok := parseAttrDate(v); ok {
+		return "date"
+	}
+	if v == "true" || v == "false" {
+		return "bool"
+	}
+	return "string"
+}
+
+// a と b の大小
+// 両方が数値なら数値、両方が日付なら日付として比較し、それ以外は文字列として比較する
+func compareAttr(a, b string) int {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := parseAttrDate(a); ok {
+		if y, ok := parseAttrDate(b); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// 比較演算子
+var attrOperators = []string{"==", "!=", ">=", "<=", "=", ">", "<"}
+
+func matchAttr(actual, op, want string) bool {
+	c := compareAttr(actual, want)
+	switch op {
+	case "=", "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// ファイルの属性が条件を満たすか
+// ファイルに属性がない場合は、ファイルが登録されているタグの属性を使う
+func (t *Tager) fileAttrMatches(file, key, op, want string) bool {
+	if v, ok := attrsOf(t.fileMeta(file))[key]; ok {
+		return matchAttr(v, op, want)
+	}
+	for _, tag := range t.tagsOf(file) {
+		if v, ok := attrsOf(t.tagNode(tag))[key]; ok && matchAttr(v, op, want) {
+			return true
+		}
+	}
+	return false
+}
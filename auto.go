@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var autoCmd = &cobra.Command{
+	Use:   "auto [flags] [PATH...]",
+	Short: "ルールに従ってファイルを自動でタグに登録する",
+	Long: `ルールに従ってファイルを自動でタグに登録する
+ルールは tager rule で登録します
+PATH がディレクトリの場合は、.gitignore と .tagerignore に一致するものを除いて再帰的に探索します
+PATH を省略した場合は、登録済みのすべてのファイルにルールを適用します
+
+一致したファイルは "ファイル  タグ  (ルール名)" の形式で表示されます
+--verbose を指定した場合は、一致しなかったルールとその理由も表示します`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, err := tager.autoRules()
+		if err != nil {
+			outputError(err)
+			os.Exit(1)
+		}
+		if len(rules) == 0 && textOutput() {
+			fmt.Println("ルールが登録されていません")
+			fmt.Println("tager rule add -h")
+			return
+		}
+		targets := make([]autoTarget, 0)
+		for _, file := range tager.allFiles() {
+			targets = append(targets, autoTarget{file: file})
+		}
+		if len(args) != 0 {
+			targets = autoTargets(args)
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i].file < targets[j].file })
+		table := newTable(0, "file", "tag", "rule", "added")
+		for _, target := range targets {
+			file := target.file
+			for _, m := range tager.applyAutoRules(file, target.base, rules, *autoFlagDryRun) {
+				if m.err != nil {
+					outputError(file, m.err)
+					continue
+				}
+				if !m.matched {
+					if *autoFlagVerbose && textOutput() {
+						fmt.Println(file, "-", "("+m.rule.name+":", m.reason+")")
+					}
+					continue
+				}
+				table.add(file, m.rule.tag, m.rule.name, m.added)
+				if textOutput() {
+					fmt.Println(file, m.rule.tag, "("+m.rule.name+")")
+				}
+			}
+		}
+		if !textOutput() {
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+		}
+		if *autoFlagDryRun {
+			return
+		}
+		if err := tager.saveConfig(); err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+var ruleCmd = &cobra.Command{
+	Use:   "rule",
+	Short: "自動登録のルールを一覧する",
+	Long:  "自動登録のルールを一覧する\nルールは tager auto で適用されます",
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, err := tager.autoRules()
+		if err != nil {
+			outputError(err)
+		}
+		table := newTable(0, "name", "tag", "conditions")
+		for _, rule := range rules {
+			table.add(rule.name, rule.tag, strings.Join(rule.conditions(), " "))
+		}
+		if !textOutput() {
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+			return
+		}
+		for _, row := range table.rows {
+			fmt.Println(row[0], "->", row[1], "\t", row[2])
+		}
+	},
+}
+
+var ruleAddCmd = &cobra.Command{
+	Use:   "add NAME TAG CONDITION...",
+	Short: "自動登録のルールを登録する",
+	Long: `自動登録のルールを登録する
+CONDITION は KEY=VALUE の形式で、すべての条件に一致したファイルを TAG に登録します
+  glob=*.go           ファイル名のパターン
+                      / を含む場合はプロジェクトのルート(なければ PATH)からの相対パスと照合し、** も使える
+  ext=.go,.mod        拡張子(, 区切り)
+  regex=/src/.*       パスの正規表現
+  min_size=1K         ファイルサイズの下限(K, M, G を付けられる)
+  max_size=10M        ファイルサイズの上限
+  mime=image/*        内容から判定した MIME タイプのパターン
+  shebang=python*     #! 行のインタプリタ名のパターン
+  gopkg=main          Go のパッケージ名のパターン
+同じ NAME のルールは置き換えられます
+例: tager rule add scripts script shebang=sh ext=.sh`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 3 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		rule := &autoRule{name: args[0], tag: args[1], cond: map[string]string{}}
+		for _, arg := range args[2:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				fmt.Println(arg, "KEY=VALUE の形式で指定してください")
+				os.Exit(1)
+			}
+			rule.cond[kv[0]] = kv[1]
+		}
+		if err := tager.addAutoRule(rule); err != nil {
+			outputFatal(err)
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var ruleRemoveCmd = &cobra.Command{
+	Use:   "remove NAME...",
+	Short: "自動登録のルールを削除する",
+	Long:  "自動登録のルールを削除する",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range args {
+			if !tager.config.HasChild("root", "rules", name) {
+				fmt.Println(name, "そのようなルールはありません")
+				continue
+			}
+			tager.config.Child("root", "rules", name).Remove()
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+// ==================== rule ====================
+
+// 条件のキー
+// 評価が軽いものから順に並べる
+var autoRuleKeys = []string{"glob", "ext", "regex", "min_size", "max_size", "mime", "shebang", "gopkg"}
+
+// 自動登録のルール
+// root.rules.<name>.tag と root.rules.<name>.<KEY> に保存する
+type autoRule struct {
+	name  string
+	tag   string
+	cond  map[string]string
+	regex *regexp.Regexp
+}
+
+func (r *autoRule) conditions() []string {
+	conds := make([]string, 0)
+	for _, key := range autoRuleKeys {
+		if v, ok := r.cond[key]; ok {
+			conds = append(conds, key+"="+v)
+		}
+	}
+	return conds
+}
+
+func (r *autoRule) check() error {
+	if len(r.cond) == 0 {
+		return errors.New(r.name + " 条件がありません")
+	}
+	for key, v := range r.cond {
+		switch key {
+		case "glob", "mime", "shebang", "gopkg":
+			if _, err := path.Match(v, ""); err != nil {
+				return errors.New(r.name + " " + key + "=" + v + ": " + err.Error())
+			}
+		case "regex":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return errors.New(r.name + " " + key + "=" + v + ": " + err.Error())
+			}
+			r.regex = re
+		case "min_size", "max_size":
+			if _, err := parseSize(v); err != nil {
+				return errors.New(r.name + " " + key + "=" + v + ": " + err.Error())
+			}
+		case "ext":
+		default:
+			return errors.New(r.name + " " + key + " そのような条件はありません")
+		}
+	}
+	return nil
+}
+
+func (t *Tager) autoRules() ([]*autoRule, error) {
+	rules := make([]*autoRule, 0)
+	if !t.config.HasChild("root", "rules") {
+		return rules, nil
+	}
+	names := t.config.Child("root", "rules").Keys()
+	sort.Strings(names)
+	for _, name := range names {
+		cur := t.config.Child("root", "rules", name)
+		rule := &autoRule{name: name, cond: map[string]string{}}
+		for _, key := range cur.Keys() {
+			if key == "tag" {
+				rule.tag = cur.Child(key).ToString()
+				continue
+			}
+			rule.cond[key] = cur.Child(key).ToString()
+		}
+		if err := rule.check(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (t *Tager) addAutoRule(rule *autoRule) error {
+	if err := rule.check(); err != nil {
+		return err
+	}
+	cur, err := t.getTag(rule.tag)
+	if err != nil {
+		return err
+	}
+	if cur.HasChild("query") {
+		return errors.New(rule.tag + " は論理式タグなのでファイルを登録できません")
+	}
+	// parent/child の形式で指定されても、タグ名の変更に追従できるようにタグ名だけを保存する
+	rule.tag = cur.BottomPath().(string)
+	node := t.config.Child("root", "rules", rule.name)
+	node.Set(map[string]interface{}{})
+	node.Child("tag").Set(rule.tag)
+	for key, v := range rule.cond {
+		node.Child(key).Set(v)
+	}
+	return nil
+}
+
+// ==================== match ====================
+
+type autoMatch struct {
+	rule    *autoRule
+	matched bool
+	// 一致しなかった理由
+	reason string
+	added  bool
+	err    error
+}
+
+// file にルールを適用する
+// base は / を含む glob を照合するときの基準のディレクトリで、空の場合はカレントディレクトリ
+// dryRun でなければ、一致したタグに登録する
+func (t *Tager) applyAutoRules(file, base string, rules []*autoRule, dryRun bool) []autoMatch {
+	full, _ := filepath.Abs(file)
+	p := &fileProbe{path: full, rel: t.autoRelPath(full, base)}
+	matches := make([]autoMatch, 0, len(rules))
+	for _, rule := range rules {
+		m := autoMatch{rule: rule}
+		m.matched, m.reason, m.err = rule.match(p)
+		if m.matched && !dryRun {
+			m.added, m.err = t.autoRegister(rule.tag, full, file)
+		}
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// glob と照合する / 区切りの相対パス
+// プロジェクトの場合はプロジェクトのルートを基準にする
+// 基準の外にあるファイルは、先頭の / を除いた絶対パスになる
+func (t *Tager) autoRelPath(full, base string) string {
+	if t.projectRoot != "" {
+		base = t.projectRoot
+	}
+	base, err := filepath.Abs(base)
+	if err == nil {
+		rel, err := filepath.Rel(base, full)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return strings.TrimPrefix(filepath.ToSlash(full), "/")
+}
+
+// 登録済みでなければタグに登録する
+func (t *Tager) autoRegister(tag, full, file string) (bool, error) {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return false, err
+	}
+	if cur.HasChild("query") {
+		return false, errors.New(tag + " は論理式タグなのでファイルを登録できません")
+	}
+	if cur.HasChild("files") && cur.Child("files").HasChild(full) {
+		return false, nil
+	}
+	return true, t.registerFile(cur, full, file)
+}
+
+func (r *autoRule) match(p *fileProbe) (bool, string, error) {
+	for _, key := range autoRuleKeys {
+		v, ok := r.cond[key]
+		if !ok {
+			continue
+		}
+		matched, err := r.matchCond(p, key, v)
+		if err != nil {
+			return false, "", err
+		}
+		if !matched {
+			return false, key + "=" + v + " に一致しません", nil
+		}
+	}
+	return true, "", nil
+}
+
+func (r *autoRule) matchCond(p *fileProbe, key, v string) (bool, error) {
+	switch key {
+	case "glob":
+		if !strings.Contains(v, "/") {
+			ok, _ := path.Match(v, filepath.Base(p.path))
+			return ok, nil
+		}
+		return matchGlobstar(strings.TrimPrefix(v, "/"), p.rel), nil
+	case "ext":
+		ext := filepath.Ext(p.path)
+		for _, e := range strings.Split(v, ",") {
+			e = strings.TrimSpace(e)
+			if e != "" && !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			if strings.EqualFold(e, ext) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "regex":
+		return r.regex.MatchString(filepath.ToSlash(p.path)), nil
+	case "min_size", "max_size":
+		info, err := p.stat()
+		if err != nil {
+			return false, err
+		}
+		size, _ := parseSize(v)
+		if key == "min_size" {
+			return info.Size() >= size, nil
+		}
+		return info.Size() <= size, nil
+	case "mime":
+		mime, err := p.mime()
+		if err != nil {
+			return false, err
+		}
+		ok, _ := path.Match(v, mime)
+		return ok, nil
+	case "shebang":
+		interp, err := p.shebang()
+		if err != nil {
+			return false, err
+		}
+		ok, _ := path.Match(v, interp)
+		return interp != "" && ok, nil
+	case "gopkg":
+		if filepath.Ext(p.path) != ".go" {
+			return false, nil
+		}
+		pkg := p.goPackage()
+		ok, _ := path.Match(v, pkg)
+		return pkg != "" && ok, nil
+	}
+	return false, nil
+}
+
+// 1K, 10M, 1G のような大きさ
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("大きさが空です")
+	}
+	unit := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * unit, err
+}
+
+// ==================== probe ====================
+
+// 条件の判定に使うファイルの情報
+// 必要になったときに一度だけ読む
+type fileProbe struct {
+	path string
+	// glob と照合する相対パス
+	rel  string
+	info os.FileInfo
+	head []byte
+}
+
+func (p *fileProbe) stat() (os.FileInfo, error) {
+	if p.info != nil {
+		return p.info, nil
+	}
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, err
+	}
+	p.info = info
+	return info, nil
+}
+
+// 先頭の 512 バイト
+func (p *fileProbe) header() ([]byte, error) {
+	if p.head != nil {
+		return p.head, nil
+	}
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	p.head = b[:n]
+	return p.head, nil
+}
+
+// パラメータを除いた MIME タイプ
+func (p *fileProbe) mime() (string, error) {
+	b, err := p.header()
+	if err != nil {
+		return "", err
+	}
+	mime := http.DetectContentType(b)
+	if n := strings.Index(mime, ";"); n >= 0 {
+		mime = mime[:n]
+	}
+	return strings.TrimSpace(mime), nil
+}
+
+// #! 行のインタプリタ名
+// /usr/bin/env python3 の場合は python3
+func (p *fileProbe) shebang() (string, error) {
+	b, err := p.header()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(string(b), "#!") {
+		return "", nil
+	}
+	line := strings.SplitN(string(b[2:]), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				return path.Base(f), nil
+			}
+		}
+	}
+	return interp, nil
+}
+
+func (p *fileProbe) goPackage() string {
+	f, err := parser.ParseFile(token.NewFileSet(), p.path, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return f.Name.Name
+}
+
+// ルールを適用するファイル
+// base はファイルを見つけたディレクトリの引数で、ファイルが直接指定された場合は空
+type autoTarget struct {
+	file string
+	base string
+}
+
+// 引数のファイルと、ディレクトリ以下のファイル
+// .gitignore と .tagerignore に一致するものは除く
+func autoTargets(args []string) []autoTarget {
+	targets := make([]autoTarget, 0)
+	for _, arg := range args {
+		base := ""
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			base = arg
+		}
+		walkFiles([]string{arg}, nil, walkOptions{}, func(file string) {
+			targets = append(targets, autoTarget{file: file, base: base})
+		})
+	}
+	return targets
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intelfike/nestmap"
+)
+
+type autoremoveOptions struct {
+	dryRun      bool
+	interactive bool
+	// 隔離したものを残す日数(0は無期限)
+	days int
+}
+
+func autoremoveOptionsOfFlags() autoremoveOptions {
+	return autoremoveOptions{
+		dryRun:      *autoremoveFlagDryRun,
+		interactive: *autoremoveFlagInteractive,
+		days:        *autoremoveFlagDays,
+	}
+}
+
+// 隔離領域
+// autoremove で解除した登録を、解除した日時とともに保存する
+// ファイルは登録したときの引数(root.tags.<tag>.files.<file> の値)と属性(root.files.<file>.attrs)も保存し、戻すときに書き戻す
+// inode やハッシュなどのマシンごとの情報は、共有される config.json に入らないように保存せず、戻すときに記録し直す
+//
+//	root.quarantine.<tag>.files.<file>.at
+//	root.quarantine.<tag>.files.<file>.arg
+//	root.quarantine.<tag>.files.<file>.meta
+//	root.quarantine.<tag>.tags.<child>
+func (t *Tager) quarantine() *nestmap.Nestmap {
+	return t.config.Child("root", "quarantine")
+}
+
+// 存在しないファイルやタグの登録を解除し、隔離する
+// kind は files か tags
+func (t *Tager) autoremove(kind string, tags []string, opts autoremoveOptions) {
+	if !opts.dryRun {
+		t.purgeQuarantine(opts.days)
+	}
+	for _, tag := range tags {
+		cur, err := t.getTag(tag)
+		if err != nil {
+			outputError(err)
+			continue
+		}
+		tag = cur.BottomPath().(string)
+		for _, name := range t.brokenEntries(cur, kind) {
+			what := "ファイル"
+			if kind == "tags" {
+				what = "タグ"
+			}
+			if opts.dryRun {
+				fmt.Println(tag, "から", name, "という"+what+"を削除します")
+				continue
+			}
+			if opts.interactive && !confirm(tag+" から "+name+" という"+what+"を削除しますか?") {
+				continue
+			}
+			at := time.Now().Format(time.RFC3339)
+			if kind == "files" {
+				entry := t.quarantine().Child(tag, kind, name)
+				entry.Remove()
+				entry.Child("at").Set(at)
+				entry.Child("arg").Set(cur.Child("files", name).ToString())
+				if meta := t.fileMeta(name); meta.Exists() {
+					for _, key := range meta.Keys() {
+						if !isLocalFileKey(key) {
+							copyNode(meta.Child(key), entry.Child("meta", key))
+						}
+					}
+				}
+				t.unregisterFile(tag, name)
+			} else {
+				t.removeChildTag(tag, name)
+				t.quarantine().Child(tag, kind, name).Set(at)
+			}
+			fmt.Println(tag, "から", name, "という"+what+"を削除しました")
+		}
+	}
+}
+
+// 存在しない登録
+func (t *Tager) brokenEntries(cur *nestmap.Nestmap, kind string) []string {
+	broken := make([]string, 0)
+	for _, name := range t.childKeys(cur, kind) {
+		if kind == "files" && pathExists(name) {
+			continue
+		}
+		if kind == "tags" && t.hasTag(name) {
+			continue
+		}
+		broken = append(broken, name)
+	}
+	sort.Strings(broken)
+	return broken
+}
+
+// days 日より前に隔離したものを削除する
+func (t *Tager) purgeQuarantine(days int) {
+	if days <= 0 || !t.config.HasChild("root", "quarantine") {
+		return
+	}
+	limit := time.Now().AddDate(0, 0, -days)
+	t.eachQuarantined(func(tag, kind, name string, at time.Time) {
+		if at.Before(limit) {
+			t.quarantine().Child(tag, kind, name).Remove()
+		}
+	})
+	t.cleanQuarantine()
+}
+
+// 隔離したものを元に戻す
+// ファイルやタグが再び存在するようになったものだけを戻す
+func (t *Tager) restoreQuarantine(tags []string, dryRun bool) {
+	if !t.config.HasChild("root", "quarantine") {
+		fmt.Println("隔離されたものはありません")
+		return
+	}
+	t.eachQuarantined(func(tag, kind, name string, at time.Time) {
+		if len(tags) != 0 && !containsString(tags, tag) {
+			return
+		}
+		cur, err := t.getTag(tag)
+		if err != nil {
+			outputError(err)
+			return
+		}
+		switch {
+		case kind == "files" && pathExists(name):
+			if dryRun {
+				fmt.Println(tag, "に", name, "というファイルを戻します")
+				return
+			}
+			// 属性を書き戻してから登録し、inode やハッシュなどを記録し直す
+			saved := t.quarantine().Child(tag, kind, name)
+			if meta := t.fileMeta(name); !meta.Exists() && saved.HasChild("meta") {
+				copyNode(saved.Child("meta"), meta)
+			}
+			// 以前の版では登録したときの引数を保存していなかった
+			arg := name
+			if saved.HasChild("arg") {
+				arg = saved.Child("arg").ToString()
+			}
+			if !cur.HasChild("files") || !cur.Child("files").HasChild(name) {
+				if err := t.registerFile(cur, name, arg); err != nil {
+					outputError(name, err)
+					return
+				}
+			}
+		case kind == "tags" && t.hasTag(name):
+			if dryRun {
+				fmt.Println(tag, "に", name, "というタグを戻します")
+				return
+			}
+			if err := t.addChildTag(tag, name); err != nil {
+				outputError(err)
+				return
+			}
+		default:
+			fmt.Println(name, "はまだ存在しません", "("+at.Format("2006-01-02")+" に", tag, "から削除)")
+			return
+		}
+		t.quarantine().Child(tag, kind, name).Remove()
+		fmt.Println(tag, "に", name, "を戻しました")
+	})
+	if !dryRun {
+		t.cleanQuarantine()
+	}
+}
+
+// タグ名の変更を隔離領域に反映する
+// 変更後のタグに既に隔離されているものがあれば、まとめる
+func (t *Tager) renameQuarantineTag(old, new string) {
+	if !t.config.HasChild("root", "quarantine") {
+		return
+	}
+	q := t.quarantine()
+	if q.HasChild(old) {
+		for _, kind := range []string{"files", "tags"} {
+			for _, name := range t.childKeys(q.Child(old), kind) {
+				if !q.HasChild(new, kind, name) {
+					copyNode(q.Child(old, kind, name), q.Child(new, kind, name))
+				}
+			}
+		}
+		q.Child(old).Remove()
+	}
+	for _, tag := range q.Keys() {
+		if !q.HasChild(tag, "tags", old) {
+			continue
+		}
+		at := q.Child(tag, "tags", old).ToString()
+		q.Child(tag, "tags", old).Remove()
+		if tag != new && !q.HasChild(tag, "tags", new) {
+			q.Child(tag, "tags", new).Set(at)
+		}
+	}
+	t.cleanQuarantine()
+}
+
+func (t *Tager) eachQuarantined(fn func(tag, kind, name string, at time.Time)) {
+	q := t.quarantine()
+	tags := q.Keys()
+	sort.Strings(tags)
+	for _, tag := range tags {
+		for _, kind := range []string{"files", "tags"} {
+			names := t.childKeys(q.Child(tag), kind)
+			sort.Strings(names)
+			for _, name := range names {
+				fn(tag, kind, name, quarantinedAt(q.Child(tag, kind, name)))
+			}
+		}
+	}
+}
+
+// 隔離した日時
+// 以前の版ではファイルも日時の文字列のみを保存していた
+func quarantinedAt(entry *nestmap.Nestmap) time.Time {
+	if entry.HasChild("at") {
+		entry = entry.Child("at")
+	}
+	at, _ := time.Parse(time.RFC3339, entry.ToString())
+	return at
+}
+
+// 空になった項目を取り除く
+func (t *Tager) cleanQuarantine() {
+	q := t.quarantine()
+	for _, tag := range q.Keys() {
+		for _, kind := range []string{"files", "tags"} {
+			if q.Child(tag).HasChild(kind) && len(q.Child(tag, kind).Keys()) == 0 {
+				q.Child(tag, kind).Remove()
+			}
+		}
+		if len(q.Child(tag).Keys()) == 0 {
+			q.Child(tag).Remove()
+		}
+	}
+	if len(q.Keys()) == 0 {
+		q.Remove()
+	}
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// y が入力されたら true
+func confirm(msg string) bool {
+	fmt.Print(msg, " [y/N] ")
+	line, _ := stdinReader.ReadString('\n')
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes"
+}
@@ -16,9 +16,21 @@ var showCommentCmd = &cobra.Command{
 			cmd.Help()
 			return
 		}
-		cur := rootTags.Child(args[0])
-		if !cur.Exists() {
-			fmt.Println(args[0], "そのようなタグは存在しません")
+		cur, err := tager.getTag(args[0])
+		if err != nil {
+			outputFatal(err)
+			return
+		}
+		if !textOutput() {
+			table := newTable(1, "tag", "comment")
+			comment := ""
+			if cur.HasChild("comment") {
+				comment = cur.Child("comment").ToString()
+			}
+			table.add(args[0], comment)
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
 			return
 		}
 		if !cur.HasChild("comment") {
@@ -38,15 +50,15 @@ var addCommentCmd = &cobra.Command{
 			cmd.Help()
 			return
 		}
-		cur := rootTags.Child(args[0])
-		if !cur.Exists() {
-			fmt.Println(args[0], "そのようなタグは存在しません")
+		cur, err := tager.getTag(args[0])
+		if err != nil {
+			outputError(err)
 			return
 		}
 		arg := strings.Join(args[1:], " ")
 		cur.Child("comment").Set(arg)
-		if err := save(); err != nil {
-			fmt.Println(err)
+		if err := tager.saveConfig(); err != nil {
+			outputError(err)
 			return
 		}
 	},
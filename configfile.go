@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+// 保存する世代数 config.json.1 .. config.json.N
+const configBackups = 5
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [flags] [N]",
+	Short: "設定ファイルをバックアップから復元する",
+	Long: `設定ファイルをバックアップから復元する
+設定ファイルは保存のたびに config.json.1 から config.json.` + strconv.Itoa(configBackups) + ` までバックアップされます
+N が未指定の場合は直前の状態(config.json.1)に戻します
+復元前の状態も config.json.1 としてバックアップされます
+保存先が json 以外の場合は、タグ以外の設定のみ復元されます`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if *restoreFlagList {
+			for n := 1; n <= configBackups; n++ {
+				info, err := os.Stat(backupName(n))
+				if err != nil {
+					continue
+				}
+				fmt.Println(n, info.ModTime().Format("2006-01-02 15:04:05"))
+			}
+			return
+		}
+		n := 1
+		if len(args) != 0 {
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n < 1 || n > configBackups {
+				fmt.Println(args[0], "1 から", configBackups, "までの番号を指定してください")
+				os.Exit(1)
+			}
+		}
+		if err := tager.restore(n); err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+func backupName(n int) string {
+	return configFile + "." + strconv.Itoa(n)
+}
+
+// 設定ファイルを書き込む
+// 一時ファイルに書き込んでから置き換えるので、途中で失敗しても壊れない
+func writeConfigFile(b []byte) error {
+	if old, err := ioutil.ReadFile(configFile); err == nil && bytes.Equal(old, b) {
+		return nil
+	}
+	if err := rotateBackups(); err != nil {
+		return err
+	}
+	return writeFileAtomic(configFile, b, 0766)
+}
+
+// 一時ファイルに書き込んでから rename で置き換える
+// 途中で失敗しても、読み込む側が書きかけのファイルを見ることはない
+func writeFileAtomic(filename string, b []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(filename)
+	f, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// rename をディスクに反映させる
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// config.json.N-1 -> config.json.N ... config.json -> config.json.1
+func rotateBackups() error {
+	if !fileExists(configFile) {
+		return nil
+	}
+	for n := configBackups - 1; n >= 1; n-- {
+		if !fileExists(backupName(n)) {
+			continue
+		}
+		if err := os.Rename(backupName(n), backupName(n+1)); err != nil {
+			return err
+		}
+	}
+	return copyFile(configFile, backupName(1))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0766)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (t *Tager) restore(n int) error {
+	b, err := ioutil.ReadFile(backupName(n))
+	if err != nil {
+		return errors.New(strconv.Itoa(n) + " そのようなバックアップはありません")
+	}
+	var m interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.New(backupName(n) + " バックアップが壊れています\n" + err.Error())
+	}
+	if err := t.setConfig(b); err != nil {
+		return err
+	}
+	if err := t.loadTags(); err != nil {
+		return err
+	}
+	return t.saveConfig()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// 1回のコマンドに渡す引数の長さの上限
+const execArgMax = 128 * 1024
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] QUERY... -- COMMAND [ARGS...]",
+	Short: "論理式に一致するファイルに対してコマンドを実行する",
+	Long: `論理式に一致するファイルに対してコマンドを実行する
+QUERY は show file と同じ論理式です
+ファイル名に空白が含まれていても、1つの引数として渡されます
+
+COMMAND の引数に次の文字列が含まれる場合は、ファイルごとにコマンドを実行します
+  {}    ファイルのパス
+  {/}   ファイル名
+  {//}  ディレクトリ
+  {.}   拡張子を除いたパス
+  {/.}  拡張子を除いたファイル名
+含まれない場合は、xargs と同じように複数のファイルを末尾に付けて実行します
+
+例:
+  tager exec golang -- chmod 644
+  tager exec -j 4 'golang & !vendor' -- gofmt -l {}`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		if dash <= 0 || dash == len(args) {
+			cmd.Help()
+			os.Exit(1)
+		}
+		files, err := tager.getFilesQuery(false, args[:dash]...)
+		if err != nil {
+			outputFatal(err)
+		}
+		jobs := execJobs(args[dash:], files, *execFlagBatch)
+		if *execFlagDryRun {
+			for _, job := range jobs {
+				fmt.Println(shellQuote(job.args))
+			}
+			return
+		}
+		// 実行するコマンドから tager を使えるように、ロックを解放する
+		unlockConfig()
+		failed := runExecJobs(jobs, *execFlagJobs)
+		if len(failed) == 0 {
+			return
+		}
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, len(failed), "/", len(jobs), "個のコマンドが失敗しました")
+		for _, job := range failed {
+			fmt.Fprintln(os.Stderr, shellQuote(job.args))
+			fmt.Fprintln(os.Stderr, "\t", job.err)
+		}
+		os.Exit(1)
+	},
+}
+
+type execJob struct {
+	args []string
+	err  error
+}
+
+var execPlaceholders = []string{"{}", "{/}", "{//}", "{.}", "{/.}"}
+
+func hasPlaceholder(args []string) bool {
+	for _, arg := range args {
+		for _, p := range execPlaceholders {
+			if strings.Contains(arg, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// プレースホルダーをファイルで置き換える
+func expandPlaceholders(arg, file string) string {
+	base := filepath.Base(file)
+	return strings.NewReplacer(
+		"{//}", filepath.Dir(file),
+		"{/.}", strings.TrimSuffix(base, filepath.Ext(base)),
+		"{/}", base,
+		"{.}", strings.TrimSuffix(file, filepath.Ext(file)),
+		"{}", file,
+	).Replace(arg)
+}
+
+// 実行するコマンドの一覧
+// プレースホルダーがなければ、batch 個または引数の長さの上限ごとにまとめる
+func execJobs(template, files []string, batch int) []*execJob {
+	jobs := make([]*execJob, 0)
+	if hasPlaceholder(template) {
+		for _, file := range files {
+			args := make([]string, len(template))
+			for n, arg := range template {
+				args[n] = expandPlaceholders(arg, file)
+			}
+			jobs = append(jobs, &execJob{args: args})
+		}
+		return jobs
+	}
+	base := 0
+	for _, arg := range template {
+		base += len(arg) + 1
+	}
+	var cur *execJob
+	size := 0
+	for _, file := range files {
+		full := cur == nil ||
+			(batch > 0 && len(cur.args)-len(template) >= batch) ||
+			(len(cur.args) != len(template) && size+len(file)+1 > execArgMax)
+		if full {
+			cur = &execJob{args: append([]string{}, template...)}
+			jobs = append(jobs, cur)
+			size = base
+		}
+		cur.args = append(cur.args, file)
+		size += len(file) + 1
+	}
+	return jobs
+}
+
+// parallel 個ずつ並列に実行し、失敗したものを返す
+func runExecJobs(jobs []*execJob, parallel int) []*execJob {
+	if parallel < 1 {
+		parallel = 1
+	}
+	ch := make(chan *execJob)
+	wg := new(sync.WaitGroup)
+	for n := 0; n < parallel; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				c := exec.Command(job.args[0], job.args[1:]...)
+				c.Stdout = os.Stdout
+				c.Stderr = os.Stderr
+				job.err = c.Run()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		ch <- job
+	}
+	close(ch)
+	wg.Wait()
+
+	failed := make([]*execJob, 0)
+	for _, job := range jobs {
+		if job.err != nil {
+			failed = append(failed, job)
+		}
+	}
+	return failed
+}
+
+// --dry-run で表示するためのシェル形式
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for n, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+			quoted[n] = arg
+			continue
+		}
+		quoted[n] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
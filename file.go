@@ -18,17 +18,55 @@ var fileCmd = &cobra.Command{
 }
 
 var showFilesCmd = &cobra.Command{
-	Use:   "file [flags] TAG...",
+	Use:   "file [flags] QUERY...",
 	Short: "ファイルを一覧する",
-	Long:  "ファイルを一覧する\n複数のタグを指定した場合はAND計算をします",
+	Long: `ファイルを一覧する
+タグを論理式で組み合わせることができます
+
+  &  AND   両方のタグに登録されている
+  |  OR    どちらかのタグに登録されている
+  !  NOT   タグに登録されていない
+  ( )      計算の優先順位
+
+演算子を省略してタグを並べた場合はAND計算をします
+例: tager show file 'golang & (api | cli) & !legacy'
+
+tager set で設定した属性を比較することもできます
+  =  !=  <  <=  >  >=
+両方が数値や日付の場合は、数値や日付として比較します
+ファイルに属性がない場合は、登録されているタグの属性を使います
+例: tager show file 'golang & priority>=2 & owner=alice'
+
+--attrs を指定した場合は、ファイル名の後にタブ区切りでファイルの属性を表示します
+-o を指定した場合は、常に attrs 列に属性が出力されます`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			cmd.Help()
 			return
 		}
-		ss, err := tager.getFilesAND(args...)
+		ss, err := tager.getFilesQuery(*showFlagR, args...)
 		if err != nil {
-			fmt.Println(err)
+			outputFatal(err)
+			return
+		}
+		if !textOutput() {
+			table := newTable(0, "path", "attrs")
+			for _, v := range ss {
+				table.add(v, tager.fileAttrsString(v))
+			}
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+			return
+		}
+		if *showFlagAttrs {
+			for _, v := range ss {
+				if attrs := tager.fileAttrsString(v); attrs != "" {
+					fmt.Println(v + "\t" + attrs)
+					continue
+				}
+				fmt.Println(v)
+			}
 			return
 		}
 		fmt.Println(strings.Join(ss, "\n"))
@@ -40,16 +78,29 @@ var showFilesCmd = &cobra.Command{
 var addFilesCmd = &cobra.Command{
 	Use:   "file [flags] TAG FILES...",
 	Short: "タグにファイルを登録する",
-	Long:  "タグにファイルを登録する\n登録先のタグが create されている必要があります",
+	Long: `タグにファイルを登録する
+登録先のタグが create されている必要があります
+
+--recursive を指定した場合は、FILES をディレクトリかファイル名のパターンとして扱い、
+ディレクトリ以下(省略時はカレントディレクトリ)のパターンに一致するファイルを登録します
+/ を含むパターンはディレクトリからの相対パスと照合します(** も使えます)
+.gitignore と .tagerignore に一致するもの、.git と .tager は除かれます
+ディレクトリより上にある ignore ファイルも、git やプロジェクトのルートまで読み込みます
+シンボリックリンクのファイルは登録し、ディレクトリは --follow-symlinks を指定した場合のみ辿ります
+例: tager add file -r golang src '*.go'
+例: tager add file -r golang 'src/**/*_test.go'`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cur := rootTags.Child(args[0])
-		if !cur.Exists() {
-			fmt.Println(args[0], "そのようなタグは存在しません")
+		if _, err := tager.getTag(args[0]); err != nil {
+			outputError(err)
 			return
 		}
-		fmt.Println(args)
 		if *addFileFlagR {
-			tager.tagAddFileRec(args[0], args[1:]...)
+			opts := walkOptions{
+				maxDepth:       *addFileFlagMaxDepth,
+				followSymlinks: *addFileFlagFollow,
+				includeDirs:    *addFileFlagDirs,
+			}
+			tager.tagAddFileRec(args[0], opts, args[1:]...)
 		} else {
 			tager.tagAddFile(args[0], args[1:]...)
 		}
@@ -61,15 +112,26 @@ var addFilesCmd = &cobra.Command{
 var removeFilesCmd = &cobra.Command{
 	Use:   "file [flags] TAG FILES...",
 	Short: "タグからファイルの登録を削除する",
-	Long:  "タグからファイルの登録を削除する\n削除するファイル名が存在していない場合は無視されます",
+	Long: `タグからファイルの登録を削除する
+削除するファイル名が存在していない場合は無視されます
+
+--recursive を指定した場合は、add file --recursive と同じようにファイルを探索します`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) <= 1 {
 			cmd.Help()
 			return
 		}
-		cur := rootTags.Child(args[0])
-		if !cur.Exists() {
-			fmt.Println(args[0], "そのようなタグは存在しません")
+		if _, err := tager.getTag(args[0]); err != nil {
+			outputError(err)
+			return
+		}
+		if *removeFileFlagR {
+			opts := walkOptions{
+				maxDepth:       *removeFileFlagMaxDepth,
+				followSymlinks: *removeFileFlagFollow,
+				includeDirs:    *removeFileFlagDirs,
+			}
+			tager.tagRemoveFileRec(args[0], opts, args[1:]...)
 			return
 		}
 		for _, v := range args[1:] {
@@ -82,7 +144,9 @@ var removeFilesCmd = &cobra.Command{
 				fmt.Println(v, "ファイル名の指定が正しくありません")
 				continue
 			}
-			cur.Child("files", full).Remove()
+			if err := tager.unregisterFile(args[0], full); err != nil {
+				outputError(err)
+			}
 		}
 	},
 }
@@ -94,24 +158,8 @@ var autoremoveFilesCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			// 引数がなければすべてが対象
-			args = rootTags.Keys()
-		}
-		for _, v := range args {
-			cur := rootTags.Child(v)
-			if !cur.Exists() {
-				fmt.Println(v, "そのようなタグはありません")
-				continue
-			}
-			if !cur.HasChild("files") {
-				continue
-			}
-			for _, file := range cur.Child("files").Keys() {
-				if !fileExists(file) {
-					continue
-				}
-				cur.Child("files", file).Remove()
-				fmt.Println(v, "から", file, "というファイルを削除しました")
-			}
+			args = tager.tagNames()
 		}
+		tager.autoremove("files", args, autoremoveOptionsOfFlags())
 	},
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/intelfike/nestmap"
+)
+
+// ファイルの同一性を判定するための情報
+// root.files.<絶対パス> に保存される
+// json 以外の保存先では store に保存され、使われたときに fileMeta で読み込む
+type fileMeta struct {
+	Size  int64
+	Mtime int64
+	Dev   uint64
+	Inode uint64
+	Hash  string
+}
+
+func statFile(path string) (*fileMeta, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New(path + " はディレクトリです")
+	}
+	meta := &fileMeta{
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+	}
+	meta.Dev, meta.Inode = fileInode(info)
+	return meta, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (m *fileMeta) write(nm *nestmap.Nestmap) {
+	nm.Child("size").Set(strconv.FormatInt(m.Size, 10))
+	nm.Child("mtime").Set(strconv.FormatInt(m.Mtime, 10))
+	nm.Child("dev").Set(strconv.FormatUint(m.Dev, 10))
+	nm.Child("inode").Set(strconv.FormatUint(m.Inode, 10))
+	nm.Child("hash").Set(m.Hash)
+}
+
+func readFileMeta(nm *nestmap.Nestmap) *fileMeta {
+	m := new(fileMeta)
+	if nm.HasChild("size") {
+		m.Size, _ = strconv.ParseInt(nm.Child("size").ToString(), 10, 64)
+	}
+	if nm.HasChild("mtime") {
+		m.Mtime, _ = strconv.ParseInt(nm.Child("mtime").ToString(), 10, 64)
+	}
+	if nm.HasChild("dev") {
+		m.Dev, _ = strconv.ParseUint(nm.Child("dev").ToString(), 10, 64)
+	}
+	if nm.HasChild("inode") {
+		m.Inode, _ = strconv.ParseUint(nm.Child("inode").ToString(), 10, 64)
+	}
+	if nm.HasChild("hash") {
+		m.Hash = nm.Child("hash").ToString()
+	}
+	return m
+}
+
+// ========== Tager ==========
+
+func (t *Tager) fileMetas() *nestmap.Nestmap {
+	return t.config.Child("root", "files")
+}
+
+// root.files.<full>
+// まだ読み込んでいないファイルの情報は store から読み込む
+func (t *Tager) fileMeta(full string) *nestmap.Nestmap {
+	if err := t.loadFile(full); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return t.fileMetas().Child(full)
+}
+
+// 登録するファイルの情報を記録する
+// 内容が変わっていなければハッシュの再計算はしない
+func (t *Tager) recordFile(full string) error {
+	meta, err := statFile(full)
+	if err != nil {
+		return err
+	}
+	cur := t.fileMeta(full)
+	if cur.Exists() {
+		old := readFileMeta(cur)
+		if old.Size == meta.Size && old.Mtime == meta.Mtime && old.Hash != "" {
+			meta.Hash = old.Hash
+		}
+	}
+	if meta.Hash == "" {
+		if meta.Hash, err = hashFile(full); err != nil {
+			return err
+		}
+	}
+	meta.write(cur)
+	return nil
+}
+
+// 存在しなくなった登録ファイルを dirs 以下から探し、見つかったものを付け替える
+// inode が一致するものを優先し、なければ内容のハッシュで照合する
+// 戻り値は 旧パス -> 新パス
+func (t *Tager) relink(dirs ...string) (map[string]string, error) {
+	missing := map[string]*fileMeta{}
+	for _, file := range t.allFiles() {
+		if fileExists(file) {
+			continue
+		}
+		if !t.fileMeta(file).Exists() {
+			continue
+		}
+		missing[file] = readFileMeta(t.fileMeta(file))
+	}
+	moved := map[string]string{}
+	if len(missing) == 0 {
+		return moved, nil
+	}
+
+	byInode := map[[2]uint64]string{}
+	bySize := map[int64][]string{}
+	for file, meta := range missing {
+		if meta.Inode != 0 {
+			byInode[[2]uint64{meta.Dev, meta.Inode}] = file
+		}
+		bySize[meta.Size] = append(bySize[meta.Size], file)
+	}
+
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			if t.isRegistered(path) {
+				return nil
+			}
+			dev, inode := fileInode(info)
+			// inode は削除後に再利用されるので、内容も一致する場合のみ信用する
+			if old, ok := byInode[[2]uint64{dev, inode}]; ok && inode != 0 && sameContent(path, info, missing[old]) {
+				if _, done := moved[old]; !done {
+					moved[old] = path
+					return nil
+				}
+			}
+			candidates := bySize[info.Size()]
+			if len(candidates) == 0 {
+				return nil
+			}
+			hash, err := hashFile(path)
+			if err != nil {
+				return nil
+			}
+			for _, old := range candidates {
+				if _, done := moved[old]; done {
+					continue
+				}
+				if missing[old].Hash == hash {
+					moved[old] = path
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for old, new := range moved {
+		t.moveFile(old, new)
+	}
+	return moved, nil
+}
+
+// path の内容が meta と同じか
+// サイズが一致し、更新日時が異なる場合はハッシュも比較する
+func sameContent(path string, info os.FileInfo, meta *fileMeta) bool {
+	if info.Size() != meta.Size {
+		return false
+	}
+	if info.ModTime().UnixNano() == meta.Mtime {
+		return true
+	}
+	hash, err := hashFile(path)
+	return err == nil && hash == meta.Hash
+}
+
+// 登録時の引数を、移動後のパスに合わせて書き換える
+// 相対パスの場合は、同じ基準のディレクトリからの相対パスにする
+func movedArg(old, new, arg string) string {
+	if arg == old || filepath.IsAbs(arg) {
+		return new
+	}
+	rel := filepath.Clean(arg)
+	if !strings.HasSuffix(old, string(filepath.Separator)+rel) {
+		return new
+	}
+	base := strings.TrimSuffix(old, string(filepath.Separator)+rel)
+	if r, err := filepath.Rel(base, new); err == nil {
+		return r
+	}
+	return new
+}
+
+// すべてのタグで、登録されているファイルのパスを付け替える
+func (t *Tager) moveFile(old, new string) {
+	tags := t.tagsOf(old)
+	newTags := t.tagsOf(new)
+	for _, tag := range tags {
+		files := t.tagNode(tag).Child("files")
+		arg := files.Child(old).ToString()
+		files.Child(old).Remove()
+		files.Child(new).Set(movedArg(old, new, arg))
+	}
+	t.fileIndex[new] = uniqueStrings(append(newTags, tags...)...)
+	delete(t.fileIndex, old)
+
+	// 属性は新しいパスに引き継ぐ
+	if t.fileMeta(old).HasChild("attrs") {
+		copyNode(t.fileMeta(old).Child("attrs"), t.fileMeta(new).Child("attrs"))
+	}
+	t.fileMeta(old).Remove()
+	if err := t.recordFile(new); err != nil {
+		outputError(err)
+	}
+}
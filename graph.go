@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// タグの親子関係
+// root.tags.<tag>.tags の登録から作る
+// 存在しないタグへの登録は無視する
+type tagGraph struct {
+	nodes    []string
+	children map[string][]string
+	// reachable の結果
+	reach map[string]map[string]bool
+}
+
+func (t *Tager) tagGraph() *tagGraph {
+	g := &tagGraph{
+		nodes:    t.tagNames(),
+		children: map[string][]string{},
+		reach:    map[string]map[string]bool{},
+	}
+	sort.Strings(g.nodes)
+	for _, tag := range g.nodes {
+		children := make([]string, 0)
+		for _, child := range t.childTagNames(tag) {
+			if t.hasTag(child) {
+				children = append(children, child)
+			}
+		}
+		sort.Strings(children)
+		g.children[tag] = children
+	}
+	return g
+}
+
+// from から辿れるすべてのタグ
+// from 自身は循環参照している場合のみ含む
+func (g *tagGraph) descendants(from string) []string {
+	result := make([]string, 0)
+	visited := map[string]bool{}
+	queue := append([]string{}, g.children[from]...)
+	for len(queue) != 0 {
+		tag := queue[0]
+		queue = queue[1:]
+		if visited[tag] {
+			continue
+		}
+		visited[tag] = true
+		result = append(result, tag)
+		queue = append(queue, g.children[tag]...)
+	}
+	return result
+}
+
+// from から to に辿れるか
+func (g *tagGraph) reachable(from, to string) bool {
+	set, ok := g.reach[from]
+	if !ok {
+		set = map[string]bool{}
+		for _, tag := range g.descendants(from) {
+			set[tag] = true
+		}
+		g.reach[from] = set
+	}
+	return set[to]
+}
+
+// from から targets のいずれかに到達する最短の経路
+// 到達しない場合は nil
+func (g *tagGraph) path(from string, targets map[string]bool) []string {
+	if targets[from] {
+		return []string{from}
+	}
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) != 0 {
+		tag := queue[0]
+		queue = queue[1:]
+		for _, child := range g.children[tag] {
+			if _, ok := prev[child]; ok {
+				continue
+			}
+			prev[child] = tag
+			if !targets[child] {
+				queue = append(queue, child)
+				continue
+			}
+			path := []string{child}
+			for cur := tag; cur != ""; cur = prev[cur] {
+				path = append([]string{cur}, path...)
+			}
+			return path
+		}
+	}
+	return nil
+}
+
+// parent に child を登録すると循環参照になる場合は、その経路を返す
+// parent -> child -> ... -> parent
+func (g *tagGraph) cycleIfAdded(parent, child string) []string {
+	if parent == child {
+		return []string{parent, child}
+	}
+	if !g.reachable(child, parent) {
+		return nil
+	}
+	return append([]string{parent}, g.path(child, map[string]bool{parent: true})...)
+}
+
+// 循環参照をひとつ探して、その経路を返す
+// a -> b -> a
+func (g *tagGraph) findCycle() []string {
+	const (
+		white = iota
+		gray
+		black
+	)
+	color := map[string]int{}
+	stack := make([]string, 0)
+	var visit func(tag string) []string
+	visit = func(tag string) []string {
+		color[tag] = gray
+		stack = append(stack, tag)
+		for _, child := range g.children[tag] {
+			switch color[child] {
+			case gray:
+				for n, v := range stack {
+					if v == child {
+						return append(append([]string{}, stack[n:]...), child)
+					}
+				}
+			case white:
+				if cycle := visit(child); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[tag] = black
+		return nil
+	}
+	for _, tag := range g.nodes {
+		if color[tag] == white {
+			if cycle := visit(tag); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// 親タグが子タグより先になる順
+func (g *tagGraph) topoOrder() ([]string, error) {
+	indegree := map[string]int{}
+	for _, tag := range g.nodes {
+		for _, child := range g.children[tag] {
+			indegree[child]++
+		}
+	}
+	queue := make([]string, 0)
+	for _, tag := range g.nodes {
+		if indegree[tag] == 0 {
+			queue = append(queue, tag)
+		}
+	}
+	order := make([]string, 0, len(g.nodes))
+	for len(queue) != 0 {
+		tag := queue[0]
+		queue = queue[1:]
+		order = append(order, tag)
+		for _, child := range g.children[tag] {
+			indegree[child]--
+			if indegree[child] == 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+	if len(order) != len(g.nodes) {
+		return order, errors.New(strings.Join(g.findCycle(), " -> ") + " :循環参照です")
+	}
+	return order, nil
+}
+
+// from から子タグを辿り、経路ごとに fn を呼ぶ
+// path は from からの経路 (child/grandchild)
+// 同じ経路の中で既に通ったタグは辿らないので、循環参照があっても止まる
+func (g *tagGraph) walkPaths(from string, fn func(tag, path string)) {
+	onPath := map[string]bool{from: true}
+	var walk func(tag, path string)
+	walk = func(tag, path string) {
+		for _, child := range g.children[tag] {
+			if onPath[child] {
+				continue
+			}
+			p := child
+			if path != "" {
+				p = path + "/" + child
+			}
+			fn(child, p)
+			onPath[child] = true
+			walk(child, p)
+			delete(onPath, child)
+		}
+	}
+	walk(from, "")
+}
+
+// ==================== export ====================
+
+var graphCmd = &cobra.Command{
+	Use:   "graph [flags] [TAG]",
+	Short: "タグの階層をグラフとして出力する",
+	Long: `タグの階層をグラフとして出力する
+タグをノード、子タグの登録を辺として出力します
+ノードのラベルにはコメントとファイル数が付きます
+TAG を指定した場合は、TAG とその子孫のタグのみを出力します
+
+  dot      Graphviz (dot -Tsvg などで画像にできます)
+  mermaid  Mermaid (Markdown に貼り付けることができます)
+  json     ノードと辺の一覧(-o json と同じ)
+
+-o は text(--format の形式)と json のみ指定できます
+論理式の計算に失敗したタグは、ノードの error にエラーを出力します
+
+例: tager graph backend --format mermaid --files`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			cmd.Help()
+			return
+		}
+		format, err := graphFormat(cmd.Flags().Changed("format"))
+		if err != nil {
+			outputFatal(err)
+			return
+		}
+		from := ""
+		if len(args) != 0 {
+			cur, err := tager.getTag(args[0])
+			if err != nil {
+				outputFatal(err)
+				return
+			}
+			from = cur.BottomPath().(string)
+		}
+		ge := tager.graphExport(from, *graphFlagFiles)
+		switch format {
+		case "dot":
+			err = ge.writeDot(os.Stdout)
+		case "mermaid":
+			err = ge.writeMermaid(os.Stdout)
+		case "json":
+			err = ge.writeJSON(os.Stdout)
+		}
+		if err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+// --format と -o から出力形式を決める
+func graphFormat(formatChanged bool) (string, error) {
+	format := *graphFlagFormat
+	switch format {
+	case "dot", "mermaid", "json":
+	default:
+		return "", errors.New(format + " :対応していない出力形式です(dot|mermaid|json)")
+	}
+	switch *rootFlagOutput {
+	case "text":
+		return format, nil
+	case "json":
+		if formatChanged && format != "json" {
+			return "", errors.New("-o json と --format " + format + " は同時に指定できません")
+		}
+		return "json", nil
+	}
+	return "", errors.New("graph では -o " + *rootFlagOutput + " は利用できません(text|json)")
+}
+
+type graphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// ファイルの場合はファイル名
+	Label   string `json:"label"`
+	Comment string `json:"comment,omitempty"`
+	Files   int    `json:"files"`
+	// ファイルを取得できなかった場合のエラー
+	Error string `json:"error,omitempty"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type graphExport struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// 出力するノードと辺を集める
+// from が空の場合はすべてのタグ
+// ファイルを取得できなかったタグは、ノードにエラーを記録して続ける
+func (t *Tager) graphExport(from string, withFiles bool) *graphExport {
+	g := t.tagGraph()
+	tags := g.nodes
+	if from != "" {
+		tags = append([]string{from}, g.descendants(from)...)
+		sort.Strings(tags)
+	}
+	ge := &graphExport{Nodes: make([]graphNode, 0), Edges: make([]graphEdge, 0)}
+	included := map[string]bool{}
+	for _, tag := range tags {
+		included[tag] = true
+	}
+	seenFiles := map[string]bool{}
+	for _, tag := range tags {
+		files, err := t.directFiles(tag)
+		sort.Strings(files)
+		node := graphNode{ID: tag, Kind: "tag", Label: tag, Files: len(files)}
+		if err != nil {
+			node.Error = err.Error()
+		}
+		node.Comment = t.tagComment(tag)
+		ge.Nodes = append(ge.Nodes, node)
+		for _, child := range g.children[tag] {
+			if included[child] {
+				ge.Edges = append(ge.Edges, graphEdge{From: tag, To: child})
+			}
+		}
+		if !withFiles {
+			continue
+		}
+		for _, file := range files {
+			if !seenFiles[file] {
+				seenFiles[file] = true
+				ge.Nodes = append(ge.Nodes, graphNode{ID: file, Kind: "file", Label: filepath.Base(file)})
+			}
+			ge.Edges = append(ge.Edges, graphEdge{From: tag, To: file})
+		}
+	}
+	return ge
+}
+
+// ラベルの行
+func (n graphNode) lines() []string {
+	if n.Kind == "file" {
+		return []string{n.Label}
+	}
+	lines := []string{n.Label}
+	if n.Comment != "" {
+		lines = append(lines, n.Comment)
+	}
+	if n.Error != "" {
+		return append(lines, "error: "+n.Error)
+	}
+	return append(lines, fmt.Sprint(n.Files, " files"))
+}
+
+func (ge *graphExport) writeDot(w io.Writer) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph tager {")
+	fmt.Fprintln(bw, "\trankdir=LR;")
+	for _, n := range ge.Nodes {
+		shape := "box"
+		if n.Kind == "file" {
+			shape = "note"
+		}
+		label := quote.Replace(strings.Join(n.lines(), "\n"))
+		fmt.Fprintf(bw, "\t\"%s\" [shape=%s, label=\"%s\"];\n", quote.Replace(n.ID), shape, label)
+	}
+	for _, e := range ge.Edges {
+		fmt.Fprintf(bw, "\t\"%s\" -> \"%s\";\n", quote.Replace(e.From), quote.Replace(e.To))
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func (ge *graphExport) writeMermaid(w io.Writer) error {
+	// Mermaid の ID に使えない文字があるので連番にする
+	ids := map[string]string{}
+	for n, node := range ge.Nodes {
+		ids[node.ID] = fmt.Sprint("n", n)
+	}
+	quote := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "flowchart LR")
+	for _, n := range ge.Nodes {
+		lines := n.lines()
+		for i, line := range lines {
+			lines[i] = quote.Replace(line)
+		}
+		label := strings.Join(lines, "<br/>")
+		if n.Kind == "file" {
+			fmt.Fprintf(bw, "\t%s([\"%s\"])\n", ids[n.ID], label)
+			continue
+		}
+		fmt.Fprintf(bw, "\t%s[\"%s\"]\n", ids[n.ID], label)
+	}
+	for _, e := range ge.Edges {
+		fmt.Fprintf(bw, "\t%s --> %s\n", ids[e.From], ids[e.To])
+	}
+	return bw.Flush()
+}
+
+func (ge *graphExport) writeJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(ge, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
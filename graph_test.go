@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// 子タグの一覧からグラフを作る
+func newTestGraph(children map[string][]string) *tagGraph {
+	g := &tagGraph{
+		nodes:    make([]string, 0, len(children)),
+		children: children,
+		reach:    map[string]map[string]bool{},
+	}
+	for tag := range children {
+		g.nodes = append(g.nodes, tag)
+	}
+	sort.Strings(g.nodes)
+	return g
+}
+
+func TestCycleIfAdded(t *testing.T) {
+	// a -> b -> c, a -> d
+	g := newTestGraph(map[string][]string{
+		"a": {"b", "d"},
+		"b": {"c"},
+		"c": {},
+		"d": {},
+	})
+	tests := []struct {
+		parent, child string
+		want          []string
+	}{
+		{"c", "a", []string{"c", "a", "b", "c"}},
+		{"b", "a", []string{"b", "a", "b"}},
+		{"a", "a", []string{"a", "a"}},
+		{"d", "b", nil},
+		{"a", "c", nil},
+		{"c", "d", nil},
+	}
+	for _, tt := range tests {
+		if got := g.cycleIfAdded(tt.parent, tt.child); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cycleIfAdded(%q, %q) = %v, want %v", tt.parent, tt.child, got, tt.want)
+		}
+	}
+}
+
+func TestTopoOrder(t *testing.T) {
+	g := newTestGraph(map[string][]string{
+		"a": {"b", "c"},
+		"b": {"d"},
+		"c": {"d"},
+		"d": {},
+		"e": {},
+	})
+	order, err := g.topoOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "e", "b", "c", "d"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("topoOrder() = %v, want %v", order, want)
+	}
+
+	// b -> c -> b
+	g = newTestGraph(map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"b"},
+	})
+	if _, err := g.topoOrder(); err == nil {
+		t.Error("topoOrder() with a cycle: err = nil")
+	}
+	if cycle, want := g.findCycle(), []string{"b", "c", "b"}; !reflect.DeepEqual(cycle, want) {
+		t.Errorf("findCycle() = %v, want %v", cycle, want)
+	}
+}
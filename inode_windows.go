@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// Windows では inode が取得できないので、ハッシュでのみ照合する
+func fileInode(info os.FileInfo) (dev, inode uint64) {
+	return 0, 0
+}
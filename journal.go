@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// 保存する操作の数
+const journalLimit = 100
+
+var undoCmd = &cobra.Command{
+	Use:   "undo",
+	Short: "直前の操作を取り消す",
+	Long:  "直前の操作を取り消す\n取り消した操作は tager redo でやり直すことができます\n操作の後に設定ファイルを直接編集するなどして変更された値がある場合は取り消しません",
+	Run: func(cmd *cobra.Command, args []string) {
+		entry, err := tager.undo()
+		if err != nil {
+			outputFatal(err)
+		}
+		fmt.Println("取り消しました:", entry.Command)
+	},
+}
+
+var redoCmd = &cobra.Command{
+	Use:   "redo",
+	Short: "取り消した操作をやり直す",
+	Long:  "取り消した操作をやり直す",
+	Run: func(cmd *cobra.Command, args []string) {
+		entry, err := tager.redo()
+		if err != nil {
+			outputFatal(err)
+		}
+		fmt.Println("やり直しました:", entry.Command)
+	},
+}
+
+var logCmd = &cobra.Command{
+	Use:   "log [flags]",
+	Short: "操作の履歴を表示する",
+	Long:  "操作の履歴を表示する\n* は tager redo でやり直せる操作です",
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := readJournal()
+		if err != nil {
+			outputFatal(err)
+		}
+		start := 0
+		if *logFlagN > 0 && len(j.Entries) > *logFlagN {
+			start = len(j.Entries) - *logFlagN
+		}
+		for n := len(j.Entries) - 1; n >= start; n-- {
+			entry := j.Entries[n]
+			mark := " "
+			if n >= j.Pos {
+				mark = "*"
+			}
+			fmt.Println(mark, entry.Time, "tager", entry.Command)
+			tags, files := entry.affected()
+			if len(tags) != 0 {
+				fmt.Println("\ttags:", strings.Join(tags, " "))
+			}
+			if len(files) != 0 {
+				fmt.Println("\tfiles:", strings.Join(files, " "))
+			}
+		}
+	},
+}
+
+// 操作の履歴
+// Pos より後ろの操作は取り消し済み
+type journal struct {
+	Pos     int            `json:"pos"`
+	Entries []journalEntry `json:"entries"`
+}
+
+type journalEntry struct {
+	Time    string          `json:"time"`
+	Command string          `json:"command"`
+	Changes []journalChange `json:"changes"`
+}
+
+// 設定ファイルの1つの値の変更
+// 値が存在しない場合の Old, New は空
+type journalChange struct {
+	Path []string        `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+func journalFile() string {
+	return filepath.Join(filepath.Dir(configFile), "journal.json")
+}
+
+func readJournal() (*journal, error) {
+	j := new(journal)
+	b, err := ioutil.ReadFile(journalFile())
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, errors.New(journalFile() + " 履歴ファイルが壊れています\n" + err.Error())
+	}
+	return j, nil
+}
+
+func (j *journal) write() error {
+	b, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(journalFile(), b, 0766)
+}
+
+func recordJournal(old, new []byte) error {
+	changes, err := diffConfig(old, new)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	j, err := readJournal()
+	if err != nil {
+		return err
+	}
+	// 取り消した操作は新しい操作で上書きされる
+	j.Entries = append(j.Entries[:j.Pos], journalEntry{
+		Time:    time.Now().Format("2006-01-02 15:04:05"),
+		Command: strings.Join(os.Args[1:], " "),
+		Changes: changes,
+	})
+	if len(j.Entries) > journalLimit {
+		j.Entries = j.Entries[len(j.Entries)-journalLimit:]
+	}
+	j.Pos = len(j.Entries)
+	return j.write()
+}
+
+func (t *Tager) undo() (*journalEntry, error) {
+	j, err := readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j.Pos == 0 {
+		return nil, errors.New("取り消せる操作がありません")
+	}
+	entry := &j.Entries[j.Pos-1]
+	if err := t.applyJournal(entry, true); err != nil {
+		return nil, err
+	}
+	j.Pos--
+	return entry, j.write()
+}
+
+func (t *Tager) redo() (*journalEntry, error) {
+	j, err := readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j.Pos == len(j.Entries) {
+		return nil, errors.New("やり直せる操作がありません")
+	}
+	entry := &j.Entries[j.Pos]
+	if err := t.applyJournal(entry, false); err != nil {
+		return nil, err
+	}
+	j.Pos++
+	return entry, j.write()
+}
+
+// 操作の変更を設定ファイルに適用する
+// undo の場合は変更前の値に戻す
+func (t *Tager) applyJournal(entry *journalEntry, undo bool) error {
+	// 変更するタグやファイルの情報を読み込んでおかないと、一部だけが保存されてしまう
+	for _, c := range entry.Changes {
+		if len(c.Path) < 3 || c.Path[0] != "root" {
+			continue
+		}
+		switch c.Path[1] {
+		case "tags":
+			if err := t.loadTag(c.Path[2]); err != nil {
+				return err
+			}
+		case "files":
+			if err := t.loadFile(t.absPath(c.Path[2])); err != nil {
+				return err
+			}
+		}
+	}
+	snapshot, err := t.journalSnapshot()
+	if err != nil {
+		return err
+	}
+	var conf interface{}
+	if err := json.Unmarshal(snapshot, &conf); err != nil {
+		return err
+	}
+	root, ok := conf.(map[string]interface{})
+	if !ok {
+		root = map[string]interface{}{}
+	}
+	if err := checkJournal(root, entry, undo); err != nil {
+		return err
+	}
+	// 削除を先に行わないと、空のマップの削除で設定した値まで消えてしまう
+	sets := make([]journalChange, 0)
+	for _, c := range entry.Changes {
+		value := c.New
+		if undo {
+			value = c.Old
+		}
+		if len(value) == 0 {
+			removePath(root, c.Path)
+			continue
+		}
+		sets = append(sets, journalChange{Path: c.Path, New: value})
+	}
+	for _, c := range sets {
+		var v interface{}
+		if err := json.Unmarshal(c.New, &v); err != nil {
+			return err
+		}
+		setPath(root, c.Path, v)
+	}
+	b, err := json.MarshalIndent(root, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := t.setConfig(b); err != nil {
+		return err
+	}
+	if err := t.persist(b); err != nil {
+		return err
+	}
+	t.snapshot = b
+	return nil
+}
+
+// 操作の後に他のコマンドや直接の編集で変更された値があれば、上書きしないようにエラーを返す
+// undo の場合は変更後の値、redo の場合は変更前の値が今の値と一致している必要がある
+func checkJournal(root map[string]interface{}, entry *journalEntry, undo bool) error {
+	leaves := map[string]json.RawMessage{}
+	if err := flattenConfig(root, nil, leaves); err != nil {
+		return err
+	}
+	changed := make([]string, 0)
+	for _, c := range entry.Changes {
+		want := c.Old
+		if undo {
+			want = c.New
+		}
+		if !sameJSON(leaves[strings.Join(c.Path, "\x00")], want) {
+			changed = append(changed, strings.Join(c.Path, "."))
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if len(changed) > 5 {
+		changed = append(changed[:5], "...")
+	}
+	action := "やり直せません"
+	if undo {
+		action = "取り消せません"
+	}
+	return errors.New("次の値が操作の後に変更されているので" + action + "\n\t" + strings.Join(changed, "\n\t"))
+}
+
+// 履歴ファイルの値はインデントされていることがあるので、空白を除いて比較する
+func sameJSON(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// 履歴の比較に使う、前回の読み込み時、保存時の設定
+// json 以外の保存先では、その後に store から読み込んだタグやファイルの情報も含める
+func (t *Tager) journalSnapshot() ([]byte, error) {
+	if len(t.storedTags) == 0 && len(t.storedFiles) == 0 {
+		return t.snapshot, nil
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(t.snapshot, &conf); err != nil {
+		return nil, err
+	}
+	root, ok := conf["root"].(map[string]interface{})
+	if !ok {
+		root = map[string]interface{}{}
+		conf["root"] = root
+	}
+	tags, ok := root["tags"].(map[string]interface{})
+	if !ok {
+		tags = map[string]interface{}{}
+		root["tags"] = tags
+	}
+	if err := mergeStored(tags, t.storedTags, nil); err != nil {
+		return nil, err
+	}
+	files, ok := root["files"].(map[string]interface{})
+	if !ok {
+		files = map[string]interface{}{}
+	}
+	if err := mergeStored(files, t.storedFiles, t.relPath); err != nil {
+		return nil, err
+	}
+	if len(files) != 0 {
+		root["files"] = files
+	}
+	return json.MarshalIndent(conf, "", "\t")
+}
+
+// store に保存されている内容を、前回の設定にない分だけ m に加える
+func mergeStored(m map[string]interface{}, stored map[string]string, key func(string) string) error {
+	for name, b := range stored {
+		if key != nil {
+			name = key(name)
+		}
+		if _, ok := m[name]; ok || b == "" || b == staleFile {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(b), &v); err != nil {
+			return err
+		}
+		m[name] = v
+	}
+	return nil
+}
+
+// 操作の対象になったタグとファイル
+func (e *journalEntry) affected() (tags, files []string) {
+	for _, c := range e.Changes {
+		p := c.Path
+		if len(p) < 2 || p[0] != "root" {
+			continue
+		}
+		switch {
+		case p[1] == "current":
+			tags = append(tags, ".")
+		case p[1] == "tags" && len(p) >= 3:
+			tags = append(tags, p[2])
+			if len(p) >= 5 && p[3] == "files" {
+				files = append(files, p[4])
+			}
+		}
+	}
+	return uniqueStrings(tags...), uniqueStrings(files...)
+}
+
+// ==================== diff ====================
+
+func diffConfig(old, new []byte) ([]journalChange, error) {
+	oldLeaves := map[string]json.RawMessage{}
+	newLeaves := map[string]json.RawMessage{}
+	for _, v := range []struct {
+		b      []byte
+		leaves map[string]json.RawMessage
+	}{{old, oldLeaves}, {new, newLeaves}} {
+		if len(v.b) == 0 {
+			continue
+		}
+		var conf interface{}
+		if err := json.Unmarshal(v.b, &conf); err != nil {
+			return nil, err
+		}
+		if err := flattenConfig(conf, nil, v.leaves); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 0)
+	for k := range oldLeaves {
+		keys = append(keys, k)
+	}
+	for k := range newLeaves {
+		if _, ok := oldLeaves[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := make([]journalChange, 0)
+	for _, k := range keys {
+		o, n := oldLeaves[k], newLeaves[k]
+		if string(o) == string(n) {
+			continue
+		}
+		changes = append(changes, journalChange{strings.Split(k, "\x00"), o, n})
+	}
+	return changes, nil
+}
+
+// 値をパスごとに分解する
+// 空のマップもひとつの値として扱う
+func flattenConfig(v interface{}, path []string, leaves map[string]json.RawMessage) error {
+	if m, ok := v.(map[string]interface{}); ok && len(m) != 0 {
+		for k, child := range m {
+			p := append(append([]string{}, path...), k)
+			if err := flattenConfig(child, p, leaves); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	leaves[strings.Join(path, "\x00")] = b
+	return nil
+}
+
+func setPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, k := range path[:len(path)-1] {
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			m[k] = child
+		}
+		m = child
+	}
+	m[path[len(path)-1]] = v
+}
+
+// 値を削除し、空になった親のマップも root.tags.<tag>, root.files.<file> まで取り除く
+// 削除後の状態で空のマップだったものは、値の変更として後から設定し直される
+func removePath(m map[string]interface{}, path []string) {
+	parents := []map[string]interface{}{m}
+	for _, k := range path[:len(path)-1] {
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = child
+		parents = append(parents, m)
+	}
+	delete(m, path[len(path)-1])
+	for n := len(path) - 1; n >= 3; n-- {
+		if len(parents[n]) != 0 {
+			return
+		}
+		delete(parents[n-1], path[n-1])
+	}
+}
@@ -30,7 +30,7 @@ electronやWebアプリなど
 - タグ名もファイルパスも一意なため、key-value型のデータ管理を利用する。(jsonの利用)
 高速さ、処理の簡単さが魅力的。
 - タグからシンボリックリンク集を自動生成(mount機能)
-- tag1 AND tag2 / tag1 OR tag2 のような計算機能(-cオプションで実装)
+- tag1 AND tag2 / tag1 OR tag2 のような計算機能(show file の論理式で実装)
 - タグからタグへコピーする機能
 - 複数のタグを統合する機能
 -
@@ -50,11 +50,9 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/intelfike/nestmap"
@@ -63,14 +61,57 @@ import (
 
 // ==================== 定義 ====================
 var (
-	config          *nestmap.Nestmap
 	configFile      string
-	rootTags        *nestmap.Nestmap
+	rootFlagGlobal  *bool
+	rootFlagDB      *string
+	rootFlagOutput  *string
+	initFlagLocal   *bool
 	showFlagR       *bool
+	showFlagAttrs   *bool
 	mountFlagR      *bool
+	mountFlagFuse   *bool
+	mountFlagUpdate *bool
+	mountFlagList   *bool
+	mountFlagName   *string
+	mountFlagRoot   *string
+	mountFlagLink   *string
+	createFlagQuery *bool
+	createFlagP     *bool
+	copyFlagFiles   *bool
+	copyFlagTags    *bool
+	copyFlagDeep    *bool
+	copyFlagPrefix  *string
+	watchFlagRule   *[]string
+	restoreFlagList *bool
+	logFlagN        *int
+	serveFlagAddr   *string
+	execFlagJobs    *int
+	execFlagBatch   *int
+	execFlagDryRun  *bool
+	autoFlagDryRun  *bool
+	autoFlagVerbose *bool
+	graphFlagFormat *string
+	graphFlagFiles  *bool
+	setFlagTag      *bool
+	unsetFlagTag    *bool
+	showAttrFlagTag *bool
 	addFileFlagR    *bool
 	removeFileFlagR *bool
-	tager           = new(Tager)
+	// add file, remove file の --recursive
+	addFileFlagMaxDepth    *int
+	addFileFlagFollow      *bool
+	addFileFlagDirs        *bool
+	removeFileFlagMaxDepth *int
+	removeFileFlagFollow   *bool
+	removeFileFlagDirs     *bool
+	// autoremove
+	autoremoveFlagDryRun      *bool
+	autoremoveFlagInteractive *bool
+	autoremoveFlagDays        *int
+	autoremoveFlagRestore     *bool
+	tager                     = new(Tager)
+	// 設定ファイルのロックを解放する
+	unlockConfig = func() {}
 )
 
 var RootCmd = &cobra.Command{
@@ -79,8 +120,7 @@ var RootCmd = &cobra.Command{
 	Long:  "[Semantic File System]",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		if !tager.isInited() {
-			fmt.Println("初期設定がされていません\ntager init を実行してください")
-			os.Exit(1)
+			outputFatal("初期設定がされていません\ntager init を実行してください")
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -96,12 +136,43 @@ var initCmd = &cobra.Command{
 
 ~/.tager/config.json が生成されます
 apt install sshfs が実行されます
+
+--local を指定した場合は、カレントディレクトリに .tager/config.json が生成されます
+プロジェクト内のファイルはプロジェクトからの相対パスで保存されるので、
+.tager ディレクトリをリポジトリに含めてタグを共有することができます
+ファイルの inode やハッシュ、マウントの情報などマシンごとに異なるものは
+.tager/local.json に保存され、.tager/.gitignore でリポジトリから除外されます
+bolt 保存先の tags.db も除外されるので、タグを共有する場合は tager store shard を使ってください
+
+設定ファイルは次の順に探されます
+  --db PATH
+  --global (~/.tager/config.json)
+  環境変数 TAGER_DB
+  カレントディレクトリから親ディレクトリを辿って見つけた .tager/config.json
+  ~/.tager/config.json
 `,
+	// 初期設定がされていなくても実行できるようにする
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
 	Run: func(cmd *cobra.Command, args []string) {
-		if !tager.isInited() {
-			tager.init()
-		} else {
+		if *initFlagLocal {
+			created, err := tager.initLocal()
+			if err != nil {
+				outputFatal(err)
+			}
+			if !created {
+				fmt.Println("初期設定済みです")
+			}
+			return
+		}
+		if tager.isInited() {
 			fmt.Println("初期設定済みです")
+			return
+		}
+		if err := lockConfig(); err != nil {
+			outputFatal(err)
+		}
+		if err := tager.init(); err != nil {
+			outputFatal(err)
 		}
 	},
 }
@@ -110,6 +181,8 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "バージョン番号を表示する",
 	Long:  "バージョン番号を表示する",
+	// 初期設定がされていなくても実行できるようにする
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("tager v1.0")
 	},
@@ -124,13 +197,26 @@ var infoCmd = &cobra.Command{
 			// リンク切れの詳細表示
 			tags, err := tager.autoremovableTags(args[0])
 			if err != nil {
-				fmt.Println(err)
+				outputFatal(err)
+				return
+			}
+			files, _ := tager.autoremovableFiles(args[0])
+			if !textOutput() {
+				table := newTable(2, "tag", "kind", "name")
+				for _, tag := range tags {
+					table.add(args[0], "tag", tag)
+				}
+				for _, file := range files {
+					table.add(args[0], "file", file)
+				}
+				if err := table.print(); err != nil {
+					outputFatal(err)
+				}
 				return
 			}
 			for _, tag := range tags {
 				fmt.Println(tag, "というタグのリンクが切れています")
 			}
-			files, _ := tager.autoremovableFiles(args[0])
 			for _, file := range files {
 				fmt.Println(file, "というファイルのリンクが切れています")
 			}
@@ -139,11 +225,27 @@ var infoCmd = &cobra.Command{
 			fmt.Println("tager autoremove [TAGS...]")
 			return
 		}
+		if !textOutput() {
+			current := ""
+			if tager.config.HasChild("root", "current") {
+				current = tager.config.Child("root", "current").ToString()
+			}
+			table := newTable(0, "tag", "current", "broken_tags", "broken_files")
+			for _, v := range tager.tagNames() {
+				tags, _ := tager.autoremovableTags(v)
+				files, _ := tager.autoremovableFiles(v)
+				table.add(v, v == current, len(tags), len(files))
+			}
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+			return
+		}
 		// 「現在」の情報のため、カレントタグの情報表示
-		fmt.Println("current tag:", config.Child("root", "current"))
+		fmt.Println("current tag:", tager.config.Child("root", "current"))
 		fmt.Println()
 		// autoremoveでのリンク切れ削除のチェック用
-		for _, v := range tager.rootTags.Keys() {
+		for _, v := range tager.tagNames() {
 			tags, err := tager.autoremovableTags(v)
 			if len(tags) != 0 && err == nil {
 				fmt.Println(v, "タグに", len(tags), "個のタグのリンク切れが見つかりました")
@@ -153,6 +255,16 @@ var infoCmd = &cobra.Command{
 				fmt.Println(v, "タグに", len(files), "個のファイルのリンク切れが見つかりました")
 			}
 		}
+		// 設定ファイルを直接編集した場合などに循環参照が残っていることがある
+		if _, err := tager.tagGraph().topoOrder(); err != nil {
+			outputError(err)
+		}
+		// 以前の版で作成されたタグには、今は使えない名前のものがある
+		for _, v := range tager.tagNames() {
+			if err := validateTagName(v); err != nil {
+				outputError(err, "(tager rename で変更してください)")
+			}
+		}
 		fmt.Println()
 		fmt.Println("tager info TAG で詳細を確認することができます")
 	},
@@ -161,19 +273,19 @@ var infoCmd = &cobra.Command{
 var chCmd = &cobra.Command{
 	Use:   "ch TAG",
 	Short: "カレントタグを変更する",
-	Long:  "カレントタグを変更する",
+	Long:  "カレントタグを変更する\nTAG を受け付けるコマンドでは、parent/child のように子タグを辿って指定することもできます",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		if len(args) != 1 {
 			cmd.Help()
 			os.Exit(0)
 		}
 		if err := execValis(cmd, args, tagExists); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			outputFatal(err)
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		config.Child("root", "current").Set(args[0])
+		name, _ := tager.resolveTag(args[0])
+		tager.config.Child("root", "current").Set(name)
 	},
 	PersistentPostRun: savePost,
 }
@@ -181,87 +293,195 @@ var chCmd = &cobra.Command{
 var mountCmd = &cobra.Command{
 	Use:   "mount [flags] TAG",
 	Short: "シンボリックリンク集を作成する",
-	Long:  "シンボリックリンク集を作成する\nカレントディレクトリに、指定されたタグ名と同じディレクトリ名で作成されます",
+	Long: `シンボリックリンク集を作成する
+カレントディレクトリに、指定されたタグ名と同じディレクトリ名で作成されます
+作成したリンクはディレクトリ内の .tager-mount.json に記録されます
+既に作成されている場合は、指定された内容に合わせて更新します
+
+--update を指定した場合は、作成済みのシンボリックリンク集をタグの現在の状態に合わせます
+TAG にはタグ名かディレクトリを指定します
+TAG を省略した場合は、すべてのシンボリックリンク集を更新します
+--list を指定した場合は、作成済みのシンボリックリンク集を一覧します
+削除する場合は tager umount を使います
+
+--name でリンクの名前の付け方を指定します
+  basename  ファイル名(既定)
+  relative  --root (省略時はプロジェクトのルート)からの相対パス
+  flat      / を - に置き換えた絶対パス
+  テンプレート {base} {name} {ext} {parent} {dir} を置き換えた名前
+            例: --name '{parent}/{base}'
+名前が重複した場合は name~2.ext のように番号を付けます
+--link でリンクの種類を指定します
+  symlink   シンボリックリンク(既定)
+  relative  相対パスのシンボリックリンク
+  hardlink  ハードリンク
+  copy      ファイルのコピー
+hardlink と copy は、更新時に元のファイルが変更されていれば作り直します
+--update と同時に指定した場合は、すべてのリンクを作り直します
+
+--fuse を指定した場合は、MOUNTPOINT にすべてのタグをディレクトリとしてマウントします
+終了するまでデータベースの変更が反映され続けます
+  mkdir TAG               タグを作成する
+  mkdir TAG/CHILD         子タグを登録する(なければ作成する)
+  ln -s /path/FILE TAG/   ファイルを登録する(cp -s や、マウント内での ln も可)
+  rm TAG/FILE             ファイルの登録を解除する
+  rmdir TAG/CHILD         子タグの登録を解除する
+  rmdir TAG               空のタグを削除する
+cp は cp -s のみ使えます。cp FILE TAG/ ではコピー元のパスがマウントに渡されず、
+内容だけが書き込まれるため、どのファイルを登録すればよいかわかりません
+(内容を受け取るとファイルの複製を作ることになるので、マウント内にファイルは作成できません)
+リンク名はファイル名から決まるため、ファイル名と異なる名前では登録できません
+例: tager mount --fuse ~/tags`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.ParseFlags(args)
+		if *mountFlagList {
+			showMounts()
+			return
+		}
+		opts := mountOptions{Naming: *mountFlagName, Root: *mountFlagRoot, LinkType: *mountFlagLink}
+		if opts.Root != "" {
+			opts.Root, _ = filepath.Abs(opts.Root)
+		}
+		if *mountFlagUpdate {
+			var newOpts *mountOptions
+			if cmd.Flags().Changed("name") || cmd.Flags().Changed("root") || cmd.Flags().Changed("link") {
+				newOpts = &opts
+			}
+			dirs := tager.mountDirs()
+			if len(args) != 0 {
+				dirs = make([]string, len(args))
+				for n, arg := range args {
+					dirs[n] = mountDirOf(arg)
+				}
+			}
+			for _, dir := range dirs {
+				errs, err := tager.updateMount(dir, newOpts)
+				printMountErrors(dir, errs, err)
+			}
+			if err := tager.saveConfig(); err != nil {
+				outputError(err)
+			}
+			return
+		}
 		if len(args) != 1 {
 			cmd.Help()
 			return
 		}
-		dir := "tager-" + args[0]
-
-		cur := rootTags.Child(args[0])
-		if !cur.Exists() {
-			fmt.Println(args[0], "そのようなタグは存在しません")
+		if *mountFlagFuse {
+			// マウント中も他のコマンドが実行できるように、ロックと保存先は操作のたびに取得する
+			tager.closeStore()
+			unlockConfig()
+			if err := tager.mountFuse(args[0]); err != nil {
+				outputFatal(err)
+			}
 			return
 		}
-
-		if err := os.Mkdir(dir, 0777); err != nil {
+		dir := mountDirName(args[0])
+		errs, err := tager.mountTag(args[0], dir, *mountFlagR, opts)
+		if err != nil {
 			fmt.Println("tag:", args[0])
-			fmt.Println(err)
+			outputError(err)
 			return
 		}
-		if cur.HasChild("files") {
-			for _, v := range cur.Child("files").Keys() {
-				newname := strings.Replace(v, "/", "-", -1)
-				if err := os.Symlink(v, dir+"/"+newname); err != nil {
-					fmt.Println(err)
-					continue
-				}
-			}
+		for _, err := range errs {
+			outputError(err)
 		}
-		if *mountFlagR {
-			recNestTag(cur, dir, func(nm *nestmap.Nestmap, path string) {
-				path = path + "/" + nm.BottomPath().(string)
-				if err := os.Mkdir(path, 0777); err != nil {
-					fmt.Println("tag:", path)
-					fmt.Println(err)
-					return
-				}
-				if !nm.HasChild("files") {
-					return
-				}
-				for _, v := range nm.Child("files").Keys() {
-					newname := strings.Replace(v, "/", "-", -1)
-					if err := os.Symlink(v, path+"/"+newname); err != nil {
-						fmt.Println("tag:", v)
-						fmt.Println(err)
-						continue
-					}
-				}
-			})
+		if err := tager.saveConfig(); err != nil {
+			outputError(err)
 		}
 	},
 }
 
+var umountCmd = &cobra.Command{
+	Use:   "umount [TAG|DIR...]",
+	Short: "シンボリックリンク集を削除する",
+	Long: `シンボリックリンク集を削除する
+tager mount で作成したリンクとディレクトリのみを削除します
+他のファイルが置かれている場合、そのディレクトリは残ります`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			return
+		}
+		for _, arg := range args {
+			dir := mountDirOf(arg)
+			errs, err := tager.umount(dir)
+			printMountErrors(dir, errs, err)
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+func printMountErrors(dir string, errs []error, err error) {
+	if err != nil {
+		fmt.Println("dir:", dir)
+		outputError(err)
+		return
+	}
+	for _, err := range errs {
+		outputError(err)
+	}
+}
+
+func showMounts() {
+	table := newTable(0, "dir", "tag", "recursive")
+	for _, dir := range tager.mountDirs() {
+		cur := tager.mounts().Child(dir)
+		table.add(dir, cur.Child("tag").ToString(), cur.HasChild("recursive"))
+	}
+	if !textOutput() {
+		if err := table.print(); err != nil {
+			outputFatal(err)
+		}
+		return
+	}
+	for _, row := range table.rows {
+		if row[2].(bool) {
+			fmt.Println(row[0], row[1], "(recursive)")
+			continue
+		}
+		fmt.Println(row[0], row[1])
+	}
+}
+
 var createCmd = &cobra.Command{
 	Use:   "create [flags] TAG",
 	Short: "新しいタグを作成する",
-	Long:  "新しいタグを作成する",
+	Long: `新しいタグを作成する
+parent/child のように指定した場合は、child を作成して parent に子タグとして登録します
+--parents を指定した場合は、mkdir -p のように途中のタグも作成して登録します
+例: tager create -p lang/go/web
+
+--query を指定した場合は、論理式を保存したタグを作成します
+ファイルは登録できず、参照するたびに論理式が計算されます
+例: tager create --query hot 'backend & !archived'`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			cmd.Help()
 			return
 		}
-		root := rootTags
-		for _, v := range args {
-			if root.HasChild(v) {
-				fmt.Println(v, "というタグは既に存在しています")
-				continue
+		if *createFlagQuery {
+			if len(args) <= 1 {
+				cmd.Help()
+				return
 			}
-			if strings.ContainsAny(v, "/") {
-				fmt.Println("/", "タグ名にこれらの文字は利用できません")
+			expr := strings.Join(args[1:], " ")
+			if err := tager.createTagPath(args[0], expr, *createFlagP); err != nil {
+				outputFatal(err)
 			}
-			if v == "." {
-				fmt.Println(".", "タグ名は名前は予約されています")
+			if err := tager.saveConfig(); err != nil {
+				outputError(err)
 			}
-			// タグの初期化
-			root.Child(v).MakeMap()
-		}
-		if err := save(); err != nil {
-			fmt.Println(err)
 			return
 		}
+		for _, v := range args {
+			if err := tager.createTagPath(v, "", *createFlagP); err != nil {
+				outputError(err)
+			}
+		}
+		if err := tager.saveConfig(); err != nil {
+			outputError(err)
+		}
 	},
 }
 
@@ -274,22 +494,107 @@ var deleteCmd = &cobra.Command{
 			cmd.Help()
 			return
 		}
-		root := rootTags
 		for _, v := range args {
-			if !root.HasChild(v) {
-				fmt.Println(v, "というタグは存在しません")
+			if err := tager.deleteTag(v); err != nil {
+				outputError(err)
 				continue
 			}
-			// タグの初期化
-			root.Child(v).Remove()
 		}
-		if err := save(); err != nil {
-			fmt.Println(err)
+		if err := tager.saveConfig(); err != nil {
+			outputError(err)
 			return
 		}
 	},
 }
 
+var renameCmd = &cobra.Command{
+	Use:   "rename OLD NEW",
+	Short: "タグ名を変更する",
+	Long:  "タグ名を変更する\n他のタグからの参照やカレントタグ、自動登録のルール、マウント、隔離されたものも書き換えます\n以前の版で作成された、今は使えない名前のタグ(tager info で表示されます)も OLD に指定できます",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Help()
+			return
+		}
+		if err := tager.renameTag(args[0], args[1]); err != nil {
+			outputFatal(err)
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge SRC... DST",
+	Short: "複数のタグを統合する",
+	Long:  "複数のタグを統合する\nSRC のファイル、子タグ、コメント、属性を DST に移動し、SRC は削除されます(DST と同じ属性は DST の値を残します)\n他のタグからの参照やカレントタグ、自動登録のルール、マウント、隔離されたものも書き換えます",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) <= 1 {
+			cmd.Help()
+			return
+		}
+		if err := tager.mergeTags(args[:len(args)-1], args[len(args)-1]); err != nil {
+			outputFatal(err)
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var copyCmd = &cobra.Command{
+	Use:   "copy [flags] SRC DST",
+	Short: "タグからタグへコピーする",
+	Long: `タグからタグへコピーする
+DST が存在しない場合は作成されます
+オプションを指定しない場合は、ファイルと子タグの両方をコピーします
+タグの属性は常にコピーされます(DST と同じ属性は DST の値を残します)
+
+--deep を指定した場合は、SRC から辿れるすべてのタグを
+--prefix を付けた名前の新しいタグとしてコピーします
+例: tager copy --deep --prefix v2- release v2-release`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Help()
+			return
+		}
+		var err error
+		if *copyFlagDeep {
+			err = tager.deepCopyTag(args[0], args[1], *copyFlagPrefix)
+		} else {
+			files, tags := *copyFlagFiles, *copyFlagTags
+			if !files && !tags {
+				files, tags = true, true
+			}
+			err = tager.copyTag(args[0], args[1], files, tags)
+		}
+		if err != nil {
+			outputFatal(err)
+		}
+	},
+	PersistentPostRun: savePost,
+}
+
+var relinkCmd = &cobra.Command{
+	Use:   "relink [DIR...]",
+	Short: "移動したファイルの登録を付け替える",
+	Long: `移動したファイルの登録を付け替える
+存在しなくなった登録ファイルを DIR 以下から探し、すべてのタグで新しいパスに付け替えます
+inode が一致するファイルを優先し、見つからなければ内容のハッシュで照合します
+DIR が未指定の場合はカレントディレクトリが対象です`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+		moved, err := tager.relink(args...)
+		if err != nil {
+			outputFatal(err)
+		}
+		for old, new := range moved {
+			fmt.Println(old, "->", new)
+		}
+		fmt.Println(len(moved), "個のファイルを付け替えました")
+	},
+	PersistentPostRun: savePost,
+}
+
 var showCmd = &cobra.Command{
 	Use:   "show",
 	Short: "データを一覧する",
@@ -309,8 +614,7 @@ var addCmd = &cobra.Command{
 			os.Exit(0)
 		}
 		if err := execValis(cmd, args, tagExists); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			outputFatal(err)
 		}
 		cmd.SetArgs(args)
 	},
@@ -330,8 +634,7 @@ var removeCmd = &cobra.Command{
 			os.Exit(0)
 		}
 		if err := execValis(cmd, args, tagExists); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			outputFatal(err)
 		}
 		cmd.SetArgs(args)
 	},
@@ -344,8 +647,16 @@ var removeCmd = &cobra.Command{
 var autoremoveCmd = &cobra.Command{
 	Use:   "autoremove COMMAND [TAG...]",
 	Short: "タグから存在しないデータを自動削除する",
-	Long:  "タグから存在しないデータを自動削除する",
+	Long: `タグから存在しないデータを自動削除する
+削除した登録は --days 日の間隔離され、--restore で元に戻すことができます
+ネットワークドライブなどがマウントされていなかった場合に使います
+
+  tager autoremove --restore [TAG...]   再び存在するようになったものを元に戻す`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if *autoremoveFlagRestore {
+			tager.restoreQuarantine(args, *autoremoveFlagDryRun)
+			return
+		}
 		cmd.Help()
 	},
 	PersistentPostRun: savePost,
@@ -364,34 +675,70 @@ func execValis(cmd *cobra.Command, args []string, funcs ...func(cmd *cobra.Comma
 }
 
 func tagExists(cmd *cobra.Command, args []string) error {
-	cur := rootTags.Child(args[0])
-	if !cur.Exists() {
-		return errors.New(args[0] + " そのようなタグは存在しません")
-	}
-	return nil
+	_, err := tager.getTag(args[0])
+	return err
 }
 
 // ==================== func ====================
 func init() {
-	config = nestmap.New()
-	config.Indent = "\t"
-	rootTags = config.Child("root", "tags")
 	// 設定ファイルの読み込み
-	dir := os.Getenv("HOME") + "/.tager"
-	configFile = dir + "/config.json"
-
-	cobra.OnInitialize()
+	cobra.OnInitialize(checkOutputFlag, loadConfig)
+	rootFlagOutput = RootCmd.PersistentFlags().StringP("output", "o", "text", "出力形式 text|json|jsonl|csv|tsv|null")
 	RootCmd.AddCommand(initCmd, versionCmd, infoCmd, mountCmd, chCmd)
 	RootCmd.AddCommand(showCmd, createCmd, deleteCmd, addCmd, removeCmd, autoremoveCmd)
-	showCmd.AddCommand(showTagsCmd, showFilesCmd, showAllCmd, showCommentCmd)
+	RootCmd.AddCommand(renameCmd, mergeCmd, copyCmd, relinkCmd, watchCmd, restoreCmd)
+	RootCmd.AddCommand(undoCmd, redoCmd, logCmd, storeCmd, mergeDriverCmd, serveCmd)
+	RootCmd.AddCommand(execCmd, umountCmd, autoCmd, ruleCmd, graphCmd, setCmd, unsetCmd)
+	showCmd.AddCommand(showTagsCmd, showFilesCmd, showAllCmd, showCommentCmd, showTagsOfCmd, showAttrCmd)
 	addCmd.AddCommand(addTagsCmd, addFilesCmd, addCommentCmd)
 	removeCmd.AddCommand(removeTagsCmd, removeFilesCmd)
 	autoremoveCmd.AddCommand(autoremoveAllCmd, autoremoveTagsCmd, autoremoveFilesCmd)
+	ruleCmd.AddCommand(ruleAddCmd, ruleRemoveCmd)
 
+	rootFlagGlobal = RootCmd.PersistentFlags().BoolP("global", "g", false, "~/.tager/config.json を利用する")
+	rootFlagDB = RootCmd.PersistentFlags().String("db", "", "利用する設定ファイル")
+	initFlagLocal = initCmd.PersistentFlags().BoolP("local", "l", false, "カレントディレクトリにプロジェクト用の設定ファイルを作成する")
 	showFlagR = showCmd.PersistentFlags().BoolP("recursive", "r", false, "再帰的にタグを辿ってデータを表示する")
 	mountFlagR = mountCmd.PersistentFlags().BoolP("recursive", "r", false, "再帰的にファイルをマウントする")
+	mountFlagFuse = mountCmd.PersistentFlags().Bool("fuse", false, "FUSE でマウントする(引数は MOUNTPOINT)")
+	mountFlagUpdate = mountCmd.PersistentFlags().BoolP("update", "u", false, "作成済みのシンボリックリンク集を更新する")
+	mountFlagList = mountCmd.PersistentFlags().BoolP("list", "l", false, "作成済みのシンボリックリンク集を一覧する")
+	mountFlagName = mountCmd.PersistentFlags().String("name", "basename", "リンクの名前の付け方 basename|relative|flat|テンプレート")
+	mountFlagRoot = mountCmd.PersistentFlags().String("root", "", "--name relative の基準となるディレクトリ")
+	mountFlagLink = mountCmd.PersistentFlags().String("link", "symlink", "リンクの種類 symlink|relative|hardlink|copy")
+	createFlagQuery = createCmd.PersistentFlags().BoolP("query", "q", false, "論理式を保存したタグを作成する")
+	createFlagP = createCmd.PersistentFlags().BoolP("parents", "p", false, "途中のタグも作成する")
+	copyFlagFiles = copyCmd.PersistentFlags().BoolP("files", "f", false, "ファイルのみコピーする")
+	copyFlagTags = copyCmd.PersistentFlags().BoolP("tags", "t", false, "子タグのみコピーする")
+	copyFlagDeep = copyCmd.PersistentFlags().BoolP("deep", "d", false, "子孫のタグも新しいタグとしてコピーする")
+	copyFlagPrefix = copyCmd.PersistentFlags().StringP("prefix", "p", "", "--deep で作成するタグ名の接頭辞")
+	restoreFlagList = restoreCmd.PersistentFlags().BoolP("list", "l", false, "バックアップを一覧する")
+	logFlagN = logCmd.PersistentFlags().IntP("number", "n", 20, "表示する操作の数")
+	execFlagJobs = execCmd.PersistentFlags().IntP("jobs", "j", 1, "並列に実行するコマンドの数")
+	execFlagBatch = execCmd.PersistentFlags().IntP("batch", "n", 0, "1回のコマンドに渡すファイルの最大数(0は無制限)")
+	execFlagDryRun = execCmd.PersistentFlags().Bool("dry-run", false, "実行せずにコマンドを表示する")
+	serveFlagAddr = serveCmd.PersistentFlags().String("addr", "localhost:8080", "待ち受けるアドレス")
+	watchFlagRule = watchCmd.PersistentFlags().StringSliceP("rule", "R", nil, "新しいファイルに適用するルール PATTERN=TAG")
+	autoFlagDryRun = autoCmd.PersistentFlags().Bool("dry-run", false, "登録せずに一致するファイルを表示する")
+	autoFlagVerbose = autoCmd.PersistentFlags().BoolP("verbose", "v", false, "一致しなかったルールと理由も表示する")
+	graphFlagFormat = graphCmd.PersistentFlags().StringP("format", "f", "dot", "出力形式 dot|mermaid|json")
+	graphFlagFiles = graphCmd.PersistentFlags().Bool("files", false, "ファイルも出力する")
+	setFlagTag = setCmd.PersistentFlags().BoolP("tag", "t", false, "タグに属性を設定する")
+	unsetFlagTag = unsetCmd.PersistentFlags().BoolP("tag", "t", false, "タグから属性を削除する")
+	showAttrFlagTag = showAttrCmd.PersistentFlags().BoolP("tag", "t", false, "タグの属性を表示する")
+	showFlagAttrs = showFilesCmd.PersistentFlags().BoolP("attrs", "a", false, "ファイルの属性も表示する")
+	autoremoveFlagDryRun = autoremoveCmd.PersistentFlags().Bool("dry-run", false, "削除せずに削除するものを表示する")
+	autoremoveFlagInteractive = autoremoveCmd.PersistentFlags().BoolP("interactive", "i", false, "削除するごとに確認する")
+	autoremoveFlagDays = autoremoveCmd.PersistentFlags().Int("days", 30, "隔離したものを残す日数(0は無期限)")
+	autoremoveFlagRestore = autoremoveCmd.PersistentFlags().Bool("restore", false, "隔離したものを元に戻す")
 	addFileFlagR = addFilesCmd.PersistentFlags().BoolP("recursive", "r", false, "再帰的にファイルを探索してタグに登録する")
 	removeFileFlagR = removeFilesCmd.PersistentFlags().BoolP("recursive", "r", false, "再帰的にファイルを探索してタグから登録を解除する")
+	addFileFlagMaxDepth = addFilesCmd.PersistentFlags().Int("max-depth", 0, "探索するディレクトリの深さ(0は無制限)")
+	addFileFlagFollow = addFilesCmd.PersistentFlags().Bool("follow-symlinks", false, "シンボリックリンクのディレクトリも辿る")
+	addFileFlagDirs = addFilesCmd.PersistentFlags().Bool("include-dirs", false, "ディレクトリも登録する")
+	removeFileFlagMaxDepth = removeFilesCmd.PersistentFlags().Int("max-depth", 0, "探索するディレクトリの深さ(0は無制限)")
+	removeFileFlagFollow = removeFilesCmd.PersistentFlags().Bool("follow-symlinks", false, "シンボリックリンクのディレクトリも辿る")
+	removeFileFlagDirs = removeFilesCmd.PersistentFlags().Bool("include-dirs", false, "ディレクトリも登録を解除する")
 
 	// fileCmd.AddCommand(filelsCmd)
 	// taglsCmd.Use = "tags"
@@ -400,22 +747,14 @@ func init() {
 }
 
 func main() {
-	confb, err := ioutil.ReadFile(configFile)
-
-	m := new(interface{})
-
-	err = json.Unmarshal(confb, &m)
+	// コマンド実行
+	err := RootCmd.Execute()
+	unlockConfig()
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	config.Set(*m)
-
-	tager.readConfig(configFile)
-
-	// コマンド実行
-	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+	if outputFailed {
 		os.Exit(1)
 	}
 }
@@ -428,9 +767,15 @@ func fileExists(filename string) bool {
 	return !f.IsDir()
 }
 
+// ファイルかディレクトリが存在するか
+func pathExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
 func parseTagName(s string) string {
 	if s == "." {
-		current := config.Child("root", "current")
+		current := tager.config.Child("root", "current")
 		if !current.Exists() {
 			fmt.Println(". を利用しましたが、カレントタグが未登録です\ntager ch -h を参照してください")
 			os.Exit(1)
@@ -455,6 +800,25 @@ func andStrings(a, b []string) []string {
 	}
 	return c
 }
+
+// a から b に含まれるものを取り除く
+func subStrings(a, b []string) []string {
+	c := make([]string, 0)
+	for _, v := range a {
+		found := false
+		for _, v2 := range b {
+			if v == v2 {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		c = append(c, v)
+	}
+	return c
+}
 func uniqueStrings(ss ...string) []string {
 	result := make([]string, 0)
 	unique := map[string]bool{}
@@ -470,57 +834,65 @@ func uniqueStrings(ss ...string) []string {
 }
 
 func showTags(tagNames []string) {
+	if !textOutput() {
+		if err := tagTable(tagNames).print(); err != nil {
+			outputFatal(err)
+		}
+		return
+	}
 	for _, v := range tagNames {
-		if !rootTags.Child(v).HasChild("comment") {
+		if !tager.tagNode(v).HasChild("comment") {
 			fmt.Println(v)
 			continue
 		}
-		comment := rootTags.Child(v, "comment").String()
+		comment := tager.tagNode(v).Child("comment").String()
 		fmt.Println(v, ":", comment)
 	}
 }
 
-func nestTag(tags ...string) (*nestmap.Nestmap, error) {
-	tags = strings.Split(strings.Join(tags, "/"), "/")
-
-	cur := rootTags
-	for _, v := range tags {
-		if v == "" {
-			continue
+// name, comment, query
+// -r で表示するタグは 親/子 の形式なので、最後のタグの情報を出力する
+func tagTable(tagNames []string) *outputTable {
+	table := newTable(0, "name", "comment", "query")
+	for _, v := range tagNames {
+		cur := tager.tagNode(v[strings.LastIndex(v, "/")+1:])
+		comment, query := "", ""
+		if cur.HasChild("comment") {
+			comment = cur.Child("comment").ToString()
 		}
-		if !cur.HasChild(v) {
-			return nil, errors.New("tag not exists")
+		if cur.HasChild("query") {
+			query = cur.Child("query").ToString()
 		}
-		cur = rootTags.Child(v, "tags")
+		table.add(v, comment, query)
 	}
-	return cur.Parent(), nil
+	return table
 }
-func recNestTag(nm *nestmap.Nestmap, path string, cb func(*nestmap.Nestmap, string)) {
-	if !nm.HasChild("tags") {
+
+// src 以下の値をすべて dst にコピーする
+func copyNode(src, dst *nestmap.Nestmap) {
+	if !src.IsMap() {
+		// 数値や配列などの値も、文字列にせずそのままの型でコピーする
+		var v interface{}
+		b, err := src.BytesIndent()
+		if err == nil {
+			err = json.Unmarshal(b, &v)
+		}
+		if err != nil {
+			dst.Set(src.ToString())
+			return
+		}
+		dst.Set(v)
 		return
 	}
-	for _, v := range nm.Child("tags").Keys() {
-		cb(rootTags.Child(v), path)
-		recNestTag(rootTags.Child(v), path+"/"+v, cb)
+	dst.MakeMap()
+	for _, k := range src.Keys() {
+		copyNode(src.Child(k), dst.Child(k))
 	}
 }
 
-func initFile() {
-	os.Create(configFile)
-	rootTags.MakeMap()
-	save()
-}
-
 func savePost(cmd *cobra.Command, args []string) {
 	if err := tager.saveConfig(); err != nil {
-		fmt.Println(err)
+		outputError(err)
 		return
 	}
 }
-func save() error {
-	b, err := config.BytesIndent()
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(configFile, b, 0766)
-}
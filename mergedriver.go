@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var mergeDriverCmd = &cobra.Command{
+	Use:   "merge-driver BASE OURS THEIRS",
+	Short: "git のマージドライバとしてタグのデータをマージする",
+	Long: `git のマージドライバとしてタグのデータをマージする
+config.json と、shard 保存先のタグごとのファイルやファイルの属性を3方向マージします
+結果は OURS に書き込まれ、衝突があった場合は終了コード 1 で終了します
+
+ファイルの登録や子タグは、両方の変更がそれぞれ反映されます
+同じコメントを両方で書き換えた場合や、片方で削除したタグがもう片方で変更されている場合は衝突になります
+両方で異なる変更がされた値は OURS の内容が残ります
+片方で削除したタグがもう片方で変更されている場合は、変更された側のタグが残ります
+(削除した側の他の変更、親タグからの登録の解除などはそのまま反映されます)
+
+設定ファイルは読み込まないので、tager init をしていない環境でも利用できます
+
+設定例:
+  git config merge.tager.name "tager merge driver"
+  git config merge.tager.driver "tager merge-driver %O %A %B"
+  echo '.tager/*.json merge=tager' >> .gitattributes
+  echo '.tager/tags/*.json merge=tager' >> .gitattributes
+  echo '.tager/files/*.json merge=tager' >> .gitattributes
+bolt 保存先の tags.db はマージできないので、リポジトリで共有する場合は shard を使ってください`,
+	// 初期設定がされていなくても実行できるようにする
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			cmd.Help()
+			os.Exit(2)
+		}
+		files := make([]interface{}, 3)
+		for n, file := range args {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			// 追加されたファイルの BASE は空になる
+			if len(strings.TrimSpace(string(b))) == 0 {
+				files[n] = map[string]interface{}{}
+				continue
+			}
+			if err := json.Unmarshal(b, &files[n]); err != nil {
+				fmt.Fprintln(os.Stderr, file, err)
+				os.Exit(2)
+			}
+		}
+		result, conflicts, err := mergeConfig(files[0], files[1], files[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		b, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := ioutil.WriteFile(args[1], append(b, '\n'), 0766); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if len(conflicts) != 0 {
+			for _, c := range conflicts {
+				fmt.Fprintln(os.Stderr, "conflict:", c)
+			}
+			os.Exit(1)
+		}
+	},
+}
+
+// 3方向マージをする
+// 値をパスごとに分解し、片方だけが変更した値はその変更を採用する
+func mergeConfig(base, ours, theirs interface{}) (map[string]interface{}, []string, error) {
+	leaves := make([]map[string]json.RawMessage, 3)
+	for n, v := range []interface{}{base, ours, theirs} {
+		leaves[n] = map[string]json.RawMessage{}
+		if err := flattenConfig(v, nil, leaves[n]); err != nil {
+			return nil, nil, err
+		}
+	}
+	b, o, t := leaves[0], leaves[1], leaves[2]
+	conflicts := make([]string, 0)
+
+	// 片方で削除されたタグが、もう片方で変更されていたら衝突
+	// 変更された側のタグを残す
+	// 親タグからの登録の解除など、タグの外の変更は他の値と同じようにマージする
+	keep := map[string]map[string]json.RawMessage{}
+	tags := tagPrefixes(b)
+	for _, tag := range tags {
+		oSub, tSub, bSub := subLeaves(o, tag), subLeaves(t, tag), subLeaves(b, tag)
+		switch {
+		case len(oSub) == 0 && len(tSub) != 0 && !sameLeaves(tSub, bSub):
+			conflicts = append(conflicts, pathString(tag)+" ours で削除されたタグが theirs で変更されています(theirs のタグを残します)")
+			keep[tag] = tSub
+		case len(tSub) == 0 && len(oSub) != 0 && !sameLeaves(oSub, bSub):
+			conflicts = append(conflicts, pathString(tag)+" theirs で削除されたタグが ours で変更されています(ours のタグを残します)")
+			keep[tag] = oSub
+		}
+	}
+
+	keys := make([]string, 0)
+	for _, m := range leaves {
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	keys = uniqueStrings(keys...)
+	sort.Strings(keys)
+
+	result := map[string]json.RawMessage{}
+	for _, k := range keys {
+		bv, bok := b[k]
+		ov, ook := o[k]
+		tv, tok := t[k]
+		same := func(ok1 bool, v1 json.RawMessage, ok2 bool, v2 json.RawMessage) bool {
+			return ok1 == ok2 && string(v1) == string(v2)
+		}
+		v, ok := ov, ook
+		switch {
+		case same(ook, ov, bok, bv):
+			v, ok = tv, tok
+		case same(tok, tv, bok, bv), same(ook, ov, tok, tv):
+		default:
+			conflicts = append(conflicts, pathString(k)+" 両方で異なる変更がされています")
+		}
+		if ok {
+			result[k] = v
+		}
+	}
+	// 削除した側ではタグの値がすべて消えているので、変更した側のタグの値で置き換える
+	for _, tag := range tags {
+		sub, ok := keep[tag]
+		if !ok {
+			continue
+		}
+		for k := range result {
+			if k == tag || strings.HasPrefix(k, tag+"\x00") {
+				delete(result, k)
+			}
+		}
+		for k, v := range sub {
+			result[k] = v
+		}
+	}
+
+	// 空のマップを先に設定しないと、その下の値が消えてしまう
+	paths := make([]string, 0, len(result))
+	for k := range result {
+		paths = append(paths, k)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ni, nj := strings.Count(paths[i], "\x00"), strings.Count(paths[j], "\x00")
+		if ni != nj {
+			return ni < nj
+		}
+		return paths[i] < paths[j]
+	})
+	merged := map[string]interface{}{}
+	for _, k := range paths {
+		var v interface{}
+		if err := json.Unmarshal(result[k], &v); err != nil {
+			return nil, nil, err
+		}
+		if k == "" {
+			// 空の設定
+			continue
+		}
+		setPath(merged, strings.Split(k, "\x00"), v)
+	}
+	return merged, conflicts, nil
+}
+
+// config.json の場合はタグのパス(root.tags.<tag>)の一覧(整列済み)
+func tagPrefixes(leaves map[string]json.RawMessage) []string {
+	prefix := "root\x00tags\x00"
+	tags := make([]string, 0)
+	for k := range leaves {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(k, prefix), "\x00", 2)[0]
+		tags = append(tags, prefix+name)
+	}
+	tags = uniqueStrings(tags...)
+	sort.Strings(tags)
+	return tags
+}
+
+func subLeaves(leaves map[string]json.RawMessage, prefix string) map[string]json.RawMessage {
+	sub := map[string]json.RawMessage{}
+	for k, v := range leaves {
+		if k == prefix || strings.HasPrefix(k, prefix+"\x00") {
+			sub[k] = v
+		}
+	}
+	return sub
+}
+
+func sameLeaves(a, b map[string]json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if string(b[k]) != string(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func pathString(path string) string {
+	return strings.Replace(path, "\x00", ".", -1)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// JSON の文字列を3方向マージする
+func testMerge(t *testing.T, base, ours, theirs string) (interface{}, []string) {
+	t.Helper()
+	vs := make([]interface{}, 3)
+	for n, s := range []string{base, ours, theirs} {
+		if err := json.Unmarshal([]byte(s), &vs[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, conflicts, err := mergeConfig(vs[0], vs[1], vs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, conflicts
+}
+
+func expectJSON(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	var w interface{}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, w) {
+		b, _ := json.Marshal(got)
+		t.Errorf("merged = %s, want %s", b, want)
+	}
+}
+
+func TestMergeBothSides(t *testing.T) {
+	base := `{"root":{"tags":{"go":{"files":{"a.go":"a.go"}}}}}`
+	ours := `{"root":{"tags":{"go":{"files":{"a.go":"a.go","b.go":"b.go"}}}}}`
+	theirs := `{"root":{"tags":{"go":{"files":{"a.go":"a.go","c.go":"c.go"},"comment":"golang"}}}}`
+	got, conflicts := testMerge(t, base, ours, theirs)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	expectJSON(t, got, `{"root":{"tags":{"go":{"files":{"a.go":"a.go","b.go":"b.go","c.go":"c.go"},"comment":"golang"}}}}`)
+}
+
+func TestMergeSameValue(t *testing.T) {
+	base := `{"root":{"tags":{"go":{"comment":"a"}}}}`
+	ours := `{"root":{"tags":{"go":{"comment":"b"}}}}`
+	theirs := `{"root":{"tags":{"go":{"comment":"c"}}}}`
+	got, conflicts := testMerge(t, base, ours, theirs)
+	if len(conflicts) != 1 || !strings.HasPrefix(conflicts[0], "root.tags.go.comment ") {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	// 衝突した値は ours が残る
+	expectJSON(t, got, ours)
+}
+
+func TestMergeDeleteModify(t *testing.T) {
+	base := `{"root":{"tags":{
+		"lang":{"tags":{"go":"go","rust":"rust"}},
+		"go":{"files":{"a.go":"a.go"}},
+		"rust":{}}}}`
+	// ours は go を削除して lang からも解除し、theirs は go にファイルを追加した
+	ours := `{"root":{"tags":{
+		"lang":{"tags":{"rust":"rust"}},
+		"rust":{}}}}`
+	theirs := `{"root":{"tags":{
+		"lang":{"tags":{"go":"go","rust":"rust"}},
+		"go":{"files":{"a.go":"a.go","b.go":"b.go"}},
+		"rust":{}}}}`
+	for _, swap := range []bool{false, true} {
+		o, th := ours, theirs
+		if swap {
+			o, th = theirs, ours
+		}
+		got, conflicts := testMerge(t, base, o, th)
+		if len(conflicts) != 1 || !strings.HasPrefix(conflicts[0], "root.tags.go ") {
+			t.Errorf("swap=%v: conflicts = %v", swap, conflicts)
+		}
+		// 変更された側の go を残し、lang からの解除は反映する
+		expectJSON(t, got, `{"root":{"tags":{
+			"lang":{"tags":{"rust":"rust"}},
+			"go":{"files":{"a.go":"a.go","b.go":"b.go"}},
+			"rust":{}}}}`)
+	}
+}
+
+// 変更されていないタグの削除は衝突にならない
+func TestMergeDeleteUnchanged(t *testing.T) {
+	base := `{"root":{"tags":{"go":{"files":{"a.go":"a.go"}},"rust":{}}}}`
+	ours := `{"root":{"tags":{"rust":{}}}}`
+	theirs := `{"root":{"tags":{"go":{"files":{"a.go":"a.go"}},"rust":{"comment":"r"}}}}`
+	got, conflicts := testMerge(t, base, ours, theirs)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	expectJSON(t, got, `{"root":{"tags":{"rust":{"comment":"r"}}}}`)
+}
+
+func TestMergeEmptyMap(t *testing.T) {
+	// ours が最後のファイルを解除して空のマップになり、theirs は別のファイルを追加した
+	base := `{"root":{"tags":{"go":{"files":{"a.go":"a.go"}}}}}`
+	ours := `{"root":{"tags":{"go":{"files":{}}}}}`
+	theirs := `{"root":{"tags":{"go":{"files":{"a.go":"a.go","b.go":"b.go"}}}}}`
+	got, conflicts := testMerge(t, base, ours, theirs)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	expectJSON(t, got, `{"root":{"tags":{"go":{"files":{"b.go":"b.go"}}}}}`)
+
+	// 空のタグを作ったのは削除ではない
+	base = `{"root":{"tags":{"go":{"comment":"a"}}}}`
+	ours = `{"root":{"tags":{"go":{}}}}`
+	theirs = `{"root":{"tags":{"go":{"comment":"a"},"rust":{"files":{}}}}}`
+	got, conflicts = testMerge(t, base, ours, theirs)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	expectJSON(t, got, `{"root":{"tags":{"go":{},"rust":{"files":{}}}}}`)
+
+	// 追加されたファイルの BASE は空のマップになる
+	got, conflicts = testMerge(t, `{}`, `{"comment":"a"}`, `{"files":{"x":"x"}}`)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts = %v", conflicts)
+	}
+	expectJSON(t, got, `{"comment":"a","files":{"x":"x"}}`)
+}
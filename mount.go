@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/intelfike/nestmap"
+)
+
+// マウントしたディレクトリに置く、tager が作成したものの一覧
+// umount ではここに記録されたものだけを削除する
+const mountManifestName = ".tager-mount.json"
+
+type mountManifest struct {
+	Tag       string `json:"tag"`
+	Recursive bool   `json:"recursive"`
+	mountOptions
+	// ディレクトリからの相対パス -> リンク先
+	Links map[string]string `json:"links"`
+	Dirs  []string          `json:"dirs"`
+	// hardlink と copy で作成したときの大きさと更新日時
+	// 利用者が変更したものは、作り直しや umount で削除しない
+	Written map[string]linkRecord `json:"written,omitempty"`
+}
+
+type linkRecord struct {
+	Size  int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+}
+
+// 作成したリンクの状態を記録する
+func (m *mountManifest) record(dir, rel string) error {
+	if m.symlink() {
+		return nil
+	}
+	info, err := os.Lstat(filepath.Join(dir, rel))
+	if err != nil {
+		return err
+	}
+	if m.Written == nil {
+		m.Written = map[string]linkRecord{}
+	}
+	m.Written[rel] = linkRecord{info.Size(), info.ModTime().UnixNano()}
+	return nil
+}
+
+// tager が作成したリンクを削除する
+// hardlink と copy は、作成したときから変更されていれば削除しない
+func (m *mountManifest) removeLink(dir, rel string) error {
+	path := filepath.Join(dir, rel)
+	if !m.symlink() {
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			delete(m.Written, rel)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, ok := m.Written[rel]
+		if !ok || info.Size() != r.Size || info.ModTime().UnixNano() != r.Mtime {
+			return errors.New(path + " は tager が作成した後に変更されているので削除しません(不要であれば手動で削除してください)")
+		}
+	}
+	if err := removeLink(path, m.mountOptions); err != nil {
+		return err
+	}
+	delete(m.Written, rel)
+	return nil
+}
+
+// リンクの名前の付け方と作り方
+//
+//	Naming    basename  ファイル名(既定)
+//	          relative  Root からの相対パス(Root の外にあるものはファイル名)
+//	          flat      / を - に置き換えた絶対パス
+//	          それ以外  {parent}/{base} のようなテンプレート
+//	LinkType  symlink   シンボリックリンク(既定)
+//	          relative  相対パスのシンボリックリンク
+//	          hardlink  ハードリンク
+//	          copy      ファイルのコピー
+type mountOptions struct {
+	Naming   string `json:"naming,omitempty"`
+	Root     string `json:"root,omitempty"`
+	LinkType string `json:"link_type,omitempty"`
+}
+
+var mountLinkTypes = []string{"symlink", "relative", "hardlink", "copy"}
+
+func (o *mountOptions) check() error {
+	if o.Naming == "" {
+		o.Naming = "basename"
+	}
+	if o.LinkType == "" {
+		o.LinkType = "symlink"
+	}
+	switch o.Naming {
+	case "basename", "relative", "flat":
+	default:
+		if !strings.Contains(o.Naming, "{") {
+			return errors.New(o.Naming + " そのような名前の付け方はありません")
+		}
+	}
+	for _, lt := range mountLinkTypes {
+		if o.LinkType == lt {
+			return nil
+		}
+	}
+	return errors.New(o.LinkType + " そのようなリンクの種類はありません")
+}
+
+func (o mountOptions) symlink() bool {
+	return o.LinkType == "symlink" || o.LinkType == "relative"
+}
+
+// マウントの一覧
+// root.mounts.<dir> に記録する
+func (t *Tager) mounts() *nestmap.Nestmap {
+	return t.config.Child("root", "mounts")
+}
+
+// タグ名の変更をマウントの記録に反映する
+// リンクのディレクトリ名は、次の mount --update で変わる
+func (t *Tager) renameMountTag(old, new string) {
+	for _, dir := range t.mountDirs() {
+		tag := t.mounts().Child(dir, "tag")
+		if tag.ToString() != old {
+			continue
+		}
+		tag.Set(new)
+		m, err := readMountManifest(dir)
+		if err != nil {
+			continue
+		}
+		m.Tag = new
+		if err := writeMountManifest(dir, m); err != nil {
+			outputError(dir, err)
+		}
+	}
+}
+
+func (t *Tager) mountDirs() []string {
+	dirs := t.childKeys(t.config.Child("root"), "mounts")
+	sort.Strings(dirs)
+	return dirs
+}
+
+// タグのシンボリックリンク集を dir に作成する
+// recursive の場合は子タグをサブディレクトリとして作成する
+// 既に同じタグがマウントされている場合は、指定された内容に合わせて更新する
+// リンクの作成に失敗したものは errs として返す
+func (t *Tager) mountTag(tag, dir string, recursive bool, opts mountOptions) (errs []error, err error) {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	name := cur.BottomPath().(string)
+	if m, err := readMountManifest(dir); err == nil {
+		if m.Tag != name {
+			return nil, errors.New(dir + " には既に " + m.Tag + " がマウントされています")
+		}
+		m.Recursive = recursive
+		return t.remount(dir, m, &opts)
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+	m := &mountManifest{
+		Tag:          name,
+		Recursive:    recursive,
+		mountOptions: opts,
+		Links:        map[string]string{},
+		Dirs:         []string{},
+	}
+	return t.syncMount(dir, m)
+}
+
+// マウントしたディレクトリをタグの現在の状態に合わせる
+// opts が nil でなければ、名前の付け方などを変更してすべてのリンクを作り直す
+func (t *Tager) updateMount(dir string, opts *mountOptions) (errs []error, err error) {
+	m, err := readMountManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.getTag(m.Tag); err != nil {
+		return nil, err
+	}
+	return t.remount(dir, m, opts)
+}
+
+func (t *Tager) remount(dir string, m *mountManifest, opts *mountOptions) (errs []error, err error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		if err := opts.check(); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && *opts != m.mountOptions {
+		for rel := range m.Links {
+			if err := m.removeLink(dir, rel); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			delete(m.Links, rel)
+		}
+		m.mountOptions = *opts
+	}
+	mountErrs, err := t.syncMount(dir, m)
+	return append(errs, mountErrs...), err
+}
+
+// tager が作成したリンクとディレクトリを削除する
+// 利用者が置いたファイルは残す
+func (t *Tager) umount(dir string) (errs []error, err error) {
+	full, _ := filepath.Abs(dir)
+	m, err := readMountManifest(dir)
+	if err != nil {
+		if t.config.HasChild("root", "mounts", full) {
+			t.mounts().Child(full).Remove()
+		}
+		return nil, err
+	}
+	for rel := range m.Links {
+		if err := m.removeLink(dir, rel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, removeDirs(dir, m.Dirs)...)
+	if err := os.Remove(filepath.Join(dir, mountManifestName)); err != nil {
+		return errs, err
+	}
+	if err := os.Remove(dir); err != nil {
+		errs = append(errs, err)
+	}
+	if t.config.HasChild("root", "mounts", full) {
+		t.mounts().Child(full).Remove()
+	}
+	return errs, nil
+}
+
+// 引数からマウントしたディレクトリを探す
+// ディレクトリでなければタグ名として扱う
+func mountDirOf(arg string) string {
+	if _, err := readMountManifest(arg); err == nil {
+		return arg
+	}
+	return mountDirName(arg)
+}
+
+// タグをマウントするディレクトリ名
+// parent/child の場合は tager-parent-child
+func mountDirName(tag string) string {
+	return "tager-" + strings.Replace(tag, "/", "-", -1)
+}
+
+// マウントに必要なリンクとディレクトリ
+func (t *Tager) mountEntries(m *mountManifest) (links map[string]string, dirs []string, errs []error) {
+	links = map[string]string{}
+	dirs = []string{}
+	used := map[string]bool{}
+	addLinks := func(tag, path string) {
+		files, err := t.directFiles(tag)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		sort.Strings(files)
+		for _, v := range files {
+			name, err := t.linkName(v, m.mountOptions)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			rel := uniqueName(filepath.Join(path, name), used)
+			used[rel] = true
+			links[rel] = v
+			// テンプレートで作られるディレクトリ
+			for d := filepath.Dir(rel); d != "." && d != path; d = filepath.Dir(d) {
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	g := t.tagGraph()
+	if m.Recursive {
+		g.walkPaths(m.Tag, func(tag, path string) {
+			path = filepath.FromSlash(path)
+			dirs = append(dirs, path)
+			used[path] = true
+		})
+	}
+	addLinks(m.Tag, "")
+	if m.Recursive {
+		g.walkPaths(m.Tag, func(tag, path string) {
+			addLinks(tag, filepath.FromSlash(path))
+		})
+	}
+	sort.Strings(dirs)
+	return links, uniqueStrings(dirs...), errs
+}
+
+// ディレクトリからの相対パスとしてのリンクの名前
+func (t *Tager) linkName(file string, opts mountOptions) (string, error) {
+	base := filepath.Base(file)
+	switch opts.Naming {
+	case "basename":
+		return base, nil
+	case "flat":
+		return strings.Replace(file, "/", "-", -1), nil
+	case "relative":
+		root := opts.Root
+		if root == "" {
+			root = t.projectRoot
+		}
+		rel, err := filepath.Rel(root, file)
+		if root == "" || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return base, nil
+		}
+		return rel, nil
+	}
+	ext := filepath.Ext(base)
+	dir := filepath.Dir(file)
+	name := strings.NewReplacer(
+		"{base}", base,
+		"{name}", strings.TrimSuffix(base, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{parent}", filepath.Base(dir),
+		"{dir}", strings.Trim(strings.Replace(dir, "/", "-", -1), "-"),
+	).Replace(opts.Naming)
+	name = filepath.Clean(name)
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errors.New(file + " テンプレートから正しい名前が作れません: " + name)
+	}
+	return name, nil
+}
+
+// 名前が重複する場合は、拡張子の前に ~2 のように番号を付ける
+func uniqueName(name string, used map[string]bool) string {
+	if !used[name] {
+		return name
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		if s := fmt.Sprintf("%s~%d%s", stem, n, ext); !used[s] {
+			return s
+		}
+	}
+}
+
+// リンクを作成する
+func makeLink(target, path string, opts mountOptions) error {
+	switch opts.LinkType {
+	case "relative":
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, target)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(rel, path)
+	case "hardlink":
+		return os.Link(target, path)
+	case "copy":
+		if err := copyFile(target, path); err != nil {
+			return err
+		}
+		// 更新日時で、元のファイルが変更されたかを判定する
+		info, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, info.ModTime(), info.ModTime())
+	}
+	return os.Symlink(target, path)
+}
+
+// 作成済みのリンクが、元のファイルの現在の状態と一致しているか
+// hardlink は同じファイルか、copy はサイズと更新日時が同じかで判定する
+func linkCurrent(target, path string, opts mountOptions) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	if opts.symlink() {
+		return true
+	}
+	src, err := os.Stat(target)
+	if err != nil {
+		// 元のファイルが無くなった場合は、作り直さずに残す
+		return true
+	}
+	if opts.LinkType == "hardlink" {
+		return os.SameFile(info, src)
+	}
+	return info.Size() == src.Size() && info.ModTime().Equal(src.ModTime())
+}
+
+func (t *Tager) syncMount(dir string, m *mountManifest) (errs []error, err error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	links, dirs, errs := t.mountEntries(m)
+
+	// 不要になったリンクとディレクトリを削除する
+	// 元のファイルと一致しなくなったリンクも削除して作り直す
+	for rel, target := range m.Links {
+		if links[rel] == target && linkCurrent(target, filepath.Join(dir, rel), m.mountOptions) {
+			// hardlink は元のファイルと共に変更されるので、記録も合わせる
+			if err := m.record(dir, rel); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := m.removeLink(dir, rel); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(m.Links, rel)
+	}
+	errs = append(errs, removeDirs(dir, subStrings(m.Dirs, dirs))...)
+
+	for _, rel := range dirs {
+		if err := os.Mkdir(filepath.Join(dir, rel), 0777); err != nil && !os.IsExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	m.Dirs = dirs
+	for rel, target := range links {
+		if _, ok := m.Links[rel]; ok {
+			continue
+		}
+		if err := makeLink(target, filepath.Join(dir, rel), m.mountOptions); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.Links[rel] = target
+		if err := m.record(dir, rel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := writeMountManifest(dir, m); err != nil {
+		return errs, err
+	}
+	full, _ := filepath.Abs(dir)
+	t.mounts().Child(full, "tag").Set(m.Tag)
+	if m.Recursive {
+		t.mounts().Child(full, "recursive").Set("true")
+	} else if t.config.HasChild("root", "mounts", full, "recursive") {
+		t.mounts().Child(full, "recursive").Remove()
+	}
+	return errs, nil
+}
+
+func readMountManifest(dir string) (*mountManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, mountManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(dir + " はマウントされていません")
+		}
+		return nil, err
+	}
+	m := new(mountManifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.Links == nil {
+		m.Links = map[string]string{}
+	}
+	return m, nil
+}
+
+func writeMountManifest(dir string, m *mountManifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, mountManifestName), b, 0666)
+}
+
+// tager が作成した種類のリンクであれば削除する
+func removeLink(path string, opts mountOptions) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if opts.symlink() && info.Mode()&os.ModeSymlink == 0 {
+		return errors.New(path + " はシンボリックリンクではないので削除しません")
+	}
+	if !opts.symlink() && !info.Mode().IsRegular() {
+		return errors.New(path + " は通常のファイルではないので削除しません")
+	}
+	return os.Remove(path)
+}
+
+// 深いものから順にディレクトリを削除する
+// 空でないディレクトリは残す
+func removeDirs(dir string, dirs []string) (errs []error) {
+	dirs = append([]string{}, dirs...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, rel := range dirs {
+		if err := os.Remove(filepath.Join(dir, rel)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,413 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// カーネルにキャッシュさせる時間
+// 短くしておくことで、他のコマンドによる変更がすぐに見えるようになる
+const fuseValid = time.Second
+
+// タグを FUSE でマウントする
+// 操作のたびに設定ファイルや保存先が変更されていないか確かめ、変更されていれば読み直すので、常に最新の状態が見える
+//
+//	MOUNTPOINT/TAG/         タグ
+//	MOUNTPOINT/TAG/CHILD/   子タグ
+//	MOUNTPOINT/TAG/FILE     登録されているファイルへのシンボリックリンク
+//
+// ファイルの実体は持たないので、マウント内でファイルを作成、書き込みすることはできない
+func (t *Tager) mountFuse(dir string) error {
+	c, err := fuse.Mount(dir, fuse.FSName("tager"), fuse.Subtype("tager"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		if err := fuse.Unmount(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return fs.Serve(c, &tagerFS{t: t})
+}
+
+type tagerFS struct {
+	t  *Tager
+	mu sync.Mutex
+	// 最後に読み込んだときの設定ファイルと保存先の状態(configStamp)
+	// 空の場合は次の操作で読み直す
+	stamp string
+}
+
+func (f *tagerFS) Root() (fs.Node, error) {
+	return &fuseRoot{f}, nil
+}
+
+// 設定ファイルが変更されていれば読み直して fn を実行する
+func (f *tagerFS) read(fn func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		return fuseError(err)
+	}
+	defer unlock()
+	if stamp := configStamp(); stamp == "" || stamp != f.stamp {
+		if err := f.t.readConfig(configFile); err != nil {
+			f.stamp = ""
+			return fuseError(err)
+		}
+		f.stamp = stamp
+	}
+	err = fn()
+	// config.json 以外の保存先は他のコマンドのために閉じるので、次の操作で読み直す
+	if _, ok := f.t.store.(*jsonStore); !ok {
+		f.t.closeStore()
+		f.stamp = ""
+	}
+	return fuseError(err)
+}
+
+// 設定ファイルを読み直して fn を実行し、変更を保存する
+func (f *tagerFS) write(fn func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// 失敗した場合は途中まで変更された設定が残るので、次の操作で読み直す
+	f.stamp = ""
+	return fuseError(f.t.update(fn))
+}
+
+// 設定ファイルと保存先の大きさと更新日時
+// 他のコマンドが保存すると、いずれかが変わる
+// (shard の保存先はファイルを置き換えて保存するので、ディレクトリの更新日時が変わる)
+func configStamp() string {
+	dir := filepath.Dir(configFile)
+	names := []string{
+		configFile,
+		localConfigFile(),
+		journalFile(),
+		filepath.Join(dir, "tags.db"),
+		filepath.Join(dir, "tags"),
+		filepath.Join(dir, "files"),
+		filepath.Join(dir, "local", "files"),
+	}
+	stamp := ""
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintln(name, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
+
+// tager のエラーを表示し、errno に変換する
+func fuseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(fuse.Errno); ok {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, err)
+	if err == errTagNotFound {
+		return fuse.ENOENT
+	}
+	return fuse.EPERM
+}
+
+// ディレクトリの中身
+// ファイル名が重複した場合は name~2.ext のように番号を付ける
+func (t *Tager) fuseEntries(tag string) (dirs []string, links map[string]string, err error) {
+	if tag == "" {
+		return t.tagNames(), map[string]string{}, nil
+	}
+	if !t.hasTag(tag) {
+		return nil, nil, errTagNotFound
+	}
+	dirs = t.childTagNames(tag)
+	files, err := t.directFiles(tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	used := map[string]bool{}
+	for _, dir := range dirs {
+		used[dir] = true
+	}
+	links = map[string]string{}
+	sort.Strings(files)
+	for _, file := range files {
+		name := uniqueName(filepath.Base(file), used)
+		used[name] = true
+		links[name] = file
+	}
+	return dirs, links, nil
+}
+
+// ==================== root ====================
+
+// すべてのタグの一覧
+type fuseRoot struct {
+	fs *tagerFS
+}
+
+func (d *fuseRoot) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	a.Valid = fuseValid
+	return nil
+}
+
+func (d *fuseRoot) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return (&fuseTagDir{d.fs, ""}).ReadDirAll(ctx)
+}
+
+func (d *fuseRoot) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	return (&fuseTagDir{d.fs, ""}).Lookup(ctx, req, resp)
+}
+
+// mkdir でタグを作成する
+func (d *fuseRoot) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	err := d.fs.write(func() error {
+		return d.fs.t.createTag(req.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fuseTagDir{d.fs, req.Name}, nil
+}
+
+// rmdir でタグを削除する
+// ファイルや子タグが登録されている場合は削除しない
+func (d *fuseRoot) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !req.Dir {
+		return fuse.EPERM
+	}
+	return d.fs.write(func() error {
+		cur, err := d.fs.t.getTag(req.Name)
+		if err != nil {
+			return err
+		}
+		if len(d.fs.t.childKeys(cur, "files")) != 0 || len(d.fs.t.childKeys(cur, "tags")) != 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		return d.fs.t.deleteTag(req.Name)
+	})
+}
+
+// ==================== tag ====================
+
+type fuseTagDir struct {
+	fs  *tagerFS
+	tag string
+}
+
+func (d *fuseTagDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	a.Valid = fuseValid
+	return nil
+}
+
+func (d *fuseTagDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	ents := make([]fuse.Dirent, 0)
+	err := d.fs.read(func() error {
+		dirs, links, err := d.fs.t.fuseEntries(d.tag)
+		if err != nil {
+			return err
+		}
+		for _, name := range dirs {
+			ents = append(ents, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+		}
+		for name := range links {
+			ents = append(ents, fuse.Dirent{Name: name, Type: fuse.DT_Link})
+		}
+		return nil
+	})
+	return ents, err
+}
+
+func (d *fuseTagDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = fuseValid
+	var node fs.Node
+	err := d.fs.read(func() error {
+		dirs, links, err := d.fs.t.fuseEntries(d.tag)
+		if err != nil {
+			return err
+		}
+		for _, name := range dirs {
+			if name == req.Name {
+				node = &fuseTagDir{d.fs, name}
+				return nil
+			}
+		}
+		if file, ok := links[req.Name]; ok {
+			node = &fuseLink{file}
+			return nil
+		}
+		return fuse.ENOENT
+	})
+	return node, err
+}
+
+// mkdir で子タグを登録する
+// タグが存在しなければ作成する
+func (d *fuseTagDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	err := d.fs.write(func() error {
+		if !d.fs.t.hasTag(req.Name) {
+			if err := d.fs.t.createTag(req.Name); err != nil {
+				return err
+			}
+		}
+		return d.fs.t.addChildTag(d.tag, req.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fuseTagDir{d.fs, req.Name}, nil
+}
+
+// ln -s や cp -s でファイルを登録する
+// リンク先は絶対パスで指定する
+func (d *fuseTagDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if !filepath.IsAbs(req.Target) {
+		fmt.Println(req.Target, "絶対パスで指定してください")
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	file := filepath.Clean(req.Target)
+	if err := d.checkName(req.NewName, file); err != nil {
+		return nil, err
+	}
+	if err := d.register(file); err != nil {
+		return nil, err
+	}
+	return &fuseLink{file}, nil
+}
+
+// マウントしたディレクトリ内での ln でファイルを登録する
+// 他のタグのディレクトリにあるリンクのみ登録でき、タグのディレクトリは登録できない
+// (子タグは mkdir で登録する)
+func (d *fuseTagDir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	link, ok := old.(*fuseLink)
+	if !ok {
+		fmt.Println(req.NewName, "タグのディレクトリは ln できません。mkdir で子タグを登録してください")
+		return nil, fuse.EPERM
+	}
+	if err := d.checkName(req.NewName, link.file); err != nil {
+		return nil, err
+	}
+	if err := d.register(link.file); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// cp FILE TAG/ ではコピー元のパスは渡されず、作成するファイル名と書き込む内容しかわからない
+// 内容を受け取って保存すると、登録ではなくファイルの複製になってしまうので、作成はできないことにする
+// cp -s (Symlink) や ln -s で登録する
+func (d *fuseTagDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	fmt.Println(req.Name, "ファイルは作成できません。cp -s /path/FILE か ln -s /path/FILE で登録してください")
+	return nil, nil, fuse.EPERM
+}
+
+// タグのディレクトリ内のリンク名はファイル名から決まるので、別の名前では登録できない
+func (d *fuseTagDir) checkName(name, file string) error {
+	if name != filepath.Base(file) {
+		fmt.Println(name, "リンク名はファイル名と同じ", filepath.Base(file), "にしてください")
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return d.fs.read(func() error {
+		dirs, links, err := d.fs.t.fuseEntries(d.tag)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if dir == name {
+				return fuse.EEXIST
+			}
+		}
+		if f, ok := links[name]; ok && f != file {
+			return fuse.EEXIST
+		}
+		return nil
+	})
+}
+
+func (d *fuseTagDir) register(file string) error {
+	if _, err := os.Stat(file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return fuse.ENOENT
+	}
+	return d.fs.write(func() error {
+		cur, err := d.fs.t.getTag(d.tag)
+		if err != nil {
+			return err
+		}
+		if cur.HasChild("query") {
+			return errors.New(d.tag + " は論理式タグなのでファイルを登録できません")
+		}
+		if cur.HasChild("files") && cur.Child("files").HasChild(file) {
+			return nil
+		}
+		return d.fs.t.registerFile(cur, file, file)
+	})
+}
+
+// rm でファイルの登録を、rmdir で子タグの登録を解除する
+func (d *fuseTagDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return d.fs.write(func() error {
+		dirs, links, err := d.fs.t.fuseEntries(d.tag)
+		if err != nil {
+			return err
+		}
+		if req.Dir {
+			for _, name := range dirs {
+				if name == req.Name {
+					return d.fs.t.removeChildTag(d.tag, name)
+				}
+			}
+			return fuse.ENOENT
+		}
+		file, ok := links[req.Name]
+		if !ok {
+			return fuse.ENOENT
+		}
+		if d.fs.t.tagNode(d.tag).HasChild("query") {
+			return errors.New(d.tag + " は論理式タグなのでファイルの登録を解除できません")
+		}
+		return d.fs.t.unregisterFile(d.tag, file)
+	})
+}
+
+// ==================== file ====================
+
+// 登録されているファイルへのシンボリックリンク
+type fuseLink struct {
+	file string
+}
+
+func (l *fuseLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(l.file))
+	a.Valid = fuseValid
+	return nil
+}
+
+func (l *fuseLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.file, nil
+}
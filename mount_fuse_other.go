@@ -0,0 +1,10 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package main
+
+import "errors"
+
+func (t *Tager) mountFuse(dir string) error {
+	return errors.New("mount --fuse は Linux と FreeBSD でのみ利用できます")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// テスト用の設定ファイルで Tager を作る
+func newTestTager(t *testing.T) (*Tager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	old := configFile
+	configFile = filepath.Join(dir, ".tager", "config.json")
+	t.Cleanup(func() { configFile = old })
+
+	tg := new(Tager)
+	if err := tg.readConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.init(); err != nil {
+		t.Fatal(err)
+	}
+	return tg, dir
+}
+
+func writeMountFile(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMountFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// copy でマウントしたファイルを編集した場合、--update で上書きしない
+func TestUpdateMountKeepsEditedCopy(t *testing.T) {
+	tg, dir := newTestTager(t)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	edited := filepath.Join(dir, "edited.txt")
+	plain := filepath.Join(dir, "plain.txt")
+	writeMountFile(t, edited, "source", base)
+	writeMountFile(t, plain, "source", base)
+
+	if err := tg.createTag("t"); err != nil {
+		t.Fatal(err)
+	}
+	cur, _ := tg.getTag("t")
+	for _, f := range []string{edited, plain} {
+		if err := tg.registerFile(cur, f, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mnt := filepath.Join(dir, "mnt")
+	errs, err := tg.mountTag("t", mnt, false, mountOptions{LinkType: "copy"})
+	if err != nil || len(errs) != 0 {
+		t.Fatal(err, errs)
+	}
+
+	// コピーを編集し、元のファイルも更新する
+	writeMountFile(t, filepath.Join(mnt, "edited.txt"), "user edit", base.Add(time.Minute))
+	writeMountFile(t, edited, "new source", base.Add(2*time.Minute))
+	writeMountFile(t, plain, "new source", base.Add(2*time.Minute))
+
+	errs, err = tg.updateMount(mnt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("errs = %v, want 1 error for the edited copy", errs)
+	}
+	if got := readMountFile(t, filepath.Join(mnt, "edited.txt")); got != "user edit" {
+		t.Errorf("edited copy = %q, want %q", got, "user edit")
+	}
+	if got := readMountFile(t, filepath.Join(mnt, "plain.txt")); got != "new source" {
+		t.Errorf("untouched copy = %q, want %q", got, "new source")
+	}
+
+	// umount でも編集したコピーは残る
+	if _, err := tg.umount(mnt); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMountFile(t, filepath.Join(mnt, "edited.txt")); got != "user edit" {
+		t.Errorf("edited copy after umount = %q, want %q", got, "user edit")
+	}
+	if _, err := os.Stat(filepath.Join(mnt, "plain.txt")); !os.IsNotExist(err) {
+		t.Errorf("untouched copy was not removed by umount: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// --output で指定できる形式
+//
+//	text   人が読むための形式(既定)
+//	json   オブジェクトの配列
+//	jsonl  1行に1つのオブジェクト
+//	csv    1行目が列名の CSV
+//	tsv    1行目が列名の TSV
+//	null   主となる列のみを NUL 区切りで出力する(xargs -0 用)
+var outputFormats = []string{"text", "json", "jsonl", "csv", "tsv", "null"}
+
+func checkOutputFlag() {
+	for _, f := range outputFormats {
+		if *rootFlagOutput == f {
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, *rootFlagOutput, "そのような出力形式はありません")
+	fmt.Fprintln(os.Stderr, outputFormats)
+	os.Exit(1)
+}
+
+func textOutput() bool {
+	return *rootFlagOutput == "text"
+}
+
+// 出力は他のプログラムやバッククォートで読まれることがあるので、
+// エラーはどの形式でも標準エラー出力に表示し、終了コードで失敗を伝える
+var outputFailed bool
+
+// エラーを表示して続ける
+// コマンドの終了後に失敗として終了する
+func outputError(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, a...)
+	outputFailed = true
+}
+
+// エラーを表示し、その場で失敗として終了する
+func outputFatal(a ...interface{}) {
+	outputError(a...)
+	os.Exit(1)
+}
+
+// コマンドの出力
+// 列はコマンドごとに固定
+type outputTable struct {
+	columns []string
+	rows    [][]interface{}
+	// null 形式で出力する列
+	primary int
+}
+
+func newTable(primary int, columns ...string) *outputTable {
+	return &outputTable{columns: columns, rows: make([][]interface{}, 0), primary: primary}
+}
+
+func (t *outputTable) add(values ...interface{}) {
+	t.rows = append(t.rows, values)
+}
+
+func (t *outputTable) objects() []map[string]interface{} {
+	objs := make([]map[string]interface{}, 0, len(t.rows))
+	for _, row := range t.rows {
+		obj := map[string]interface{}{}
+		for n, column := range t.columns {
+			obj[column] = row[n]
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+// --output の形式で出力する
+func (t *outputTable) print() error {
+	switch *rootFlagOutput {
+	case "json":
+		b, err := json.MarshalIndent(t.objects(), "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		for _, obj := range t.objects() {
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+		}
+	case "csv", "tsv":
+		w := csv.NewWriter(os.Stdout)
+		if *rootFlagOutput == "tsv" {
+			w.Comma = '\t'
+		}
+		w.Write(t.columns)
+		for _, row := range t.rows {
+			record := make([]string, len(row))
+			for n, v := range row {
+				record[n] = fmt.Sprint(v)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		return w.Error()
+	case "null":
+		for _, row := range t.rows {
+			fmt.Print(fmt.Sprint(row[t.primary]), "\x00")
+		}
+	default:
+		return errors.New(*rootFlagOutput + " そのような出力形式はありません")
+	}
+	return nil
+}
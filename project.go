@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// 設定ファイルの場所を決める
+// --db > --global > TAGER_DB > カレントディレクトリから親を辿って見つけた .tager > ~/.tager
+func resolveConfigFile() string {
+	home := filepath.Join(os.Getenv("HOME"), ".tager")
+	switch {
+	case *rootFlagDB != "":
+		return dbConfigFile(*rootFlagDB)
+	case *rootFlagGlobal:
+		return filepath.Join(home, "config.json")
+	case os.Getenv("TAGER_DB") != "":
+		return dbConfigFile(os.Getenv("TAGER_DB"))
+	}
+	if dir, err := os.Getwd(); err == nil {
+		if file := findLocalConfig(dir); file != "" {
+			return file
+		}
+	}
+	return filepath.Join(home, "config.json")
+}
+
+// ディレクトリが指定された場合はその中の config.json
+func dbConfigFile(path string) string {
+	path, _ = filepath.Abs(path)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, "config.json")
+	}
+	return path
+}
+
+// git と同じように、親ディレクトリを辿って .tager/config.json を探す
+func findLocalConfig(dir string) string {
+	for {
+		file := filepath.Join(dir, ".tager", "config.json")
+		if fileExists(file) {
+			return file
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// プロジェクトのルートディレクトリ
+// ~/.tager 以外の .tager ディレクトリの設定ファイルはプロジェクト用として扱う
+func projectRootOf(file string) string {
+	dir := filepath.Dir(file)
+	if filepath.Base(dir) != ".tager" {
+		return ""
+	}
+	if dir == filepath.Join(os.Getenv("HOME"), ".tager") {
+		return ""
+	}
+	return filepath.Dir(dir)
+}
+
+// 設定ファイルを決めてロックし、読み込む
+func loadConfig() {
+	if !usesConfig() {
+		return
+	}
+	configFile = resolveConfigFile()
+	tager.projectRoot = projectRootOf(configFile)
+	// 初期設定がされていなければ、ロックファイルなども作成しない(tager init で作成する)
+	if fileExists(configFile) {
+		// コマンドの実行中は、他のコマンドや watch が設定ファイルを書き換えないようにする
+		if err := lockConfig(); err != nil {
+			outputFatal(err)
+		}
+	}
+	if err := tager.readConfig(configFile); err != nil {
+		outputFatal(err)
+	}
+}
+
+// configFile のロックを取得する
+// 解放は unlockConfig で行う
+func lockConfig() error {
+	os.MkdirAll(filepath.Dir(configFile), 0777)
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		return errors.New(configFile + " のロックを取得できませんでした: " + err.Error())
+	}
+	unlockConfig = func() {
+		unlock()
+		unlockConfig = func() {}
+	}
+	return nil
+}
+
+// 設定ファイルを使わないコマンド
+// merge-driver は git から衝突中の設定ファイルに対して呼ばれることがあるので、読み込まない
+var configFreeCmds = []*cobra.Command{mergeDriverCmd, versionCmd}
+
+func usesConfig() bool {
+	cmd, _, err := RootCmd.Find(os.Args[1:])
+	if err != nil {
+		return true
+	}
+	for _, c := range configFreeCmds {
+		if cmd == c {
+			return false
+		}
+	}
+	return true
+}
+
+// カレントディレクトリにプロジェクト用の設定ファイルを作成する
+func (t *Tager) initLocal() (bool, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	file := filepath.Join(dir, ".tager", "config.json")
+	if fileExists(file) {
+		return false, nil
+	}
+	unlockConfig()
+	configFile = file
+	if err := lockConfig(); err != nil {
+		return false, err
+	}
+	t.projectRoot = dir
+	if err := t.readConfig(configFile); err != nil {
+		return true, err
+	}
+	if err := t.init(); err != nil {
+		return true, err
+	}
+	if err := writeGitignore(filepath.Dir(file)); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// .tager/.gitignore
+// ロックファイルやバックアップ、履歴、マシンごとの情報はリポジトリに含めない
+// bolt 保存先の tags.db はバイナリでマージできないので含めない(共有する場合は shard を使う)
+// shard 保存先の索引と、ファイルの inode やハッシュ(local/)も含めない
+const projectGitignore = `config.json.lock
+config.json.[0-9]*
+*.json.tmp*
+journal.json
+local.json
+local/
+tags.db
+tags/.index.json
+`
+
+func writeGitignore(dir string) error {
+	file := filepath.Join(dir, ".gitignore")
+	if fileExists(file) {
+		return nil
+	}
+	return ioutil.WriteFile(file, []byte(projectGitignore), 0666)
+}
+
+// ==================== path ====================
+
+// 保存する形式のパス
+// プロジェクト用の設定ファイルでは、プロジェクト内のファイルはルートからの相対パスになる
+func (t *Tager) relPath(full string) string {
+	if t.projectRoot == "" {
+		return full
+	}
+	rel, err := filepath.Rel(t.projectRoot, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return full
+	}
+	return rel
+}
+
+// 保存された形式のパスを絶対パスにする
+func (t *Tager) absPath(path string) string {
+	if t.projectRoot == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(t.projectRoot, path)
+}
+
+// 設定に含まれるファイルのパスを f で変換する
+// root.tags.<tag>.files と root.files、root.mounts、root.quarantine.<tag>.files のキーが対象
+func convertConfigPaths(conf interface{}, f func(string) string) {
+	m, _ := conf.(map[string]interface{})
+	root, _ := m["root"].(map[string]interface{})
+	if root == nil {
+		return
+	}
+	if tags, ok := root["tags"].(map[string]interface{}); ok {
+		for _, tag := range tags {
+			if tag, ok := tag.(map[string]interface{}); ok {
+				convertKeys(tag["files"], f)
+			}
+		}
+	}
+	convertKeys(root["files"], f)
+	convertKeys(root["mounts"], f)
+	if quarantine, ok := root["quarantine"].(map[string]interface{}); ok {
+		for _, tag := range quarantine {
+			if tag, ok := tag.(map[string]interface{}); ok {
+				convertKeys(tag["files"], f)
+			}
+		}
+	}
+}
+
+func convertKeys(v interface{}, f func(string) string) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, child := range m {
+		if newKey := f(k); newKey != k {
+			delete(m, k)
+			m[newKey] = child
+		}
+	}
+}
+
+func convertTagPaths(data *TagData, f func(string) string) {
+	files := map[string]string{}
+	for k, v := range data.Files {
+		files[f(k)] = v
+	}
+	if data.Files != nil {
+		data.Files = files
+	}
+}
+
+// 保存する形式の設定
+func (t *Tager) storedBytes(b []byte) ([]byte, error) {
+	if t.projectRoot == "" {
+		return b, nil
+	}
+	var conf interface{}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, err
+	}
+	convertConfigPaths(conf, t.relPath)
+	splitLocalConfig(conf, t.filesInConfig())
+	return json.MarshalIndent(conf, "", "\t")
+}
+
+// ==================== local ====================
+
+// プロジェクト用の設定ファイルでは、マシンごとに異なる情報を local.json に分けて保存する
+//
+//	root.files.<file> の attrs 以外(inode やハッシュなど、json の保存先の場合のみ)
+//	root.mounts
+func localConfigFile() string {
+	return filepath.Join(filepath.Dir(configFile), "local.json")
+}
+
+// json 以外の保存先では、ファイルの情報は store に保存されるので local.json には分けない
+func (t *Tager) filesInConfig() bool {
+	_, ok := t.store.(*jsonStore)
+	return ok
+}
+
+// ファイルの情報のうち、マシンごとに異なるもの
+func isLocalFileKey(key string) bool {
+	return key != "attrs"
+}
+
+// conf からマシンごとの情報を取り除き、取り除いたものを返す
+// files が false の場合は root.files を取り除かない
+func splitLocalConfig(conf interface{}, files bool) map[string]interface{} {
+	localRoot := map[string]interface{}{}
+	local := map[string]interface{}{"root": localRoot}
+	m, _ := conf.(map[string]interface{})
+	root, _ := m["root"].(map[string]interface{})
+	if root == nil {
+		return local
+	}
+	if mounts, ok := root["mounts"]; ok {
+		localRoot["mounts"] = mounts
+		delete(root, "mounts")
+	}
+	if !files {
+		return local
+	}
+	fileMetas, ok := root["files"].(map[string]interface{})
+	if !ok {
+		return local
+	}
+	localFiles := map[string]interface{}{}
+	for file, v := range fileMetas {
+		entry, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		localEntry := map[string]interface{}{}
+		for k, v := range entry {
+			if isLocalFileKey(k) {
+				localEntry[k] = v
+				delete(entry, k)
+			}
+		}
+		if len(localEntry) != 0 {
+			localFiles[file] = localEntry
+		}
+		if len(entry) == 0 {
+			delete(fileMetas, file)
+		}
+	}
+	if len(fileMetas) == 0 {
+		delete(root, "files")
+	}
+	if len(localFiles) != 0 {
+		localRoot["files"] = localFiles
+	}
+	return local
+}
+
+// local.json の内容を conf に戻す
+func mergeLocalConfig(conf interface{}) error {
+	b, err := ioutil.ReadFile(localConfigFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var local interface{}
+	if err := json.Unmarshal(b, &local); err != nil {
+		return errors.New(localConfigFile() + " が壊れています\n" + err.Error())
+	}
+	if m, ok := conf.(map[string]interface{}); ok {
+		mergeMaps(m, local)
+	}
+	return nil
+}
+
+func mergeMaps(dst map[string]interface{}, src interface{}) {
+	m, _ := src.(map[string]interface{})
+	for k, v := range m {
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		d, ok := dst[k].(map[string]interface{})
+		if !ok {
+			d = map[string]interface{}{}
+			dst[k] = d
+		}
+		mergeMaps(d, sub)
+	}
+}
+
+// マシンごとの情報を local.json に保存する
+func (t *Tager) writeLocalConfig() error {
+	if t.projectRoot == "" {
+		return nil
+	}
+	b, err := t.config.BytesIndent()
+	if err != nil {
+		return err
+	}
+	var conf interface{}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+	convertConfigPaths(conf, t.relPath)
+	if b, err = json.MarshalIndent(splitLocalConfig(conf, t.filesInConfig()), "", "\t"); err != nil {
+		return err
+	}
+	if old, err := ioutil.ReadFile(localConfigFile()); err == nil && bytes.Equal(old, b) {
+		return nil
+	}
+	return writeFileAtomic(localConfigFile(), b, 0666)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// タグの論理式
+//   golang & (api | cli) & !legacy
+//   golang AND (api OR cli) AND NOT legacy
+// 演算子を省略して並べた場合はANDとして扱う
+//   golang api  ==  golang & api
+// 属性を比較することもできる(attr.go)
+//   golang & priority>=2 & owner!=alice
+
+// ==================== lexer ====================
+
+type queryTokenKind int
+
+const (
+	queryEOF queryTokenKind = iota
+	queryIdent
+	queryAttr
+	queryAnd
+	queryOr
+	queryNot
+	queryLParen
+	queryRParen
+)
+
+func (k queryTokenKind) String() string {
+	switch k {
+	case queryEOF:
+		return "式の終わり"
+	case queryIdent:
+		return "タグ名"
+	case queryAttr:
+		return "属性の比較"
+	case queryAnd:
+		return "&"
+	case queryOr:
+		return "|"
+	case queryNot:
+		return "!"
+	case queryLParen:
+		return "("
+	case queryRParen:
+		return ")"
+	}
+	return "?"
+}
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int // 何文字目か(0始まり)
+}
+
+// 構文エラー
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%d文字目: %s", e.Pos+1, e.Msg)
+}
+
+func isQueryOperator(r rune) bool {
+	return strings.ContainsRune("&|!()", r)
+}
+
+func lexQuery(expr string) []queryToken {
+	rs := []rune(expr)
+	tokens := make([]queryToken, 0)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '&':
+			tokens = append(tokens, queryToken{queryAnd, "&", i})
+		case r == '|':
+			tokens = append(tokens, queryToken{queryOr, "|", i})
+		case r == '!':
+			tokens = append(tokens, queryToken{queryNot, "!", i})
+		case r == '(':
+			tokens = append(tokens, queryToken{queryLParen, "(", i})
+		case r == ')':
+			tokens = append(tokens, queryToken{queryRParen, ")", i})
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) {
+				// != は否定ではなく比較演算子
+				if isQueryOperator(rs[i]) && !(rs[i] == '!' && i+1 < len(rs) && rs[i+1] == '=') {
+					break
+				}
+				i++
+			}
+			word := string(rs[start:i])
+			kind := queryIdent
+			if strings.ContainsAny(word, "=<>") {
+				kind = queryAttr
+			}
+			switch word {
+			case "AND":
+				kind = queryAnd
+			case "OR":
+				kind = queryOr
+			case "NOT":
+				kind = queryNot
+			}
+			tokens = append(tokens, queryToken{kind, word, start})
+			continue
+		}
+		i++
+	}
+	tokens = append(tokens, queryToken{queryEOF, "", len(rs)})
+	return tokens
+}
+
+// ==================== AST ====================
+
+type queryNode interface {
+	// recursive の場合は、タグの子タグのファイルも含める
+	eval(t *Tager, recursive bool) ([]string, error)
+}
+
+type queryTag struct {
+	name string
+	pos  int
+}
+
+// key op value
+type queryAttrNode struct {
+	key, op, value string
+	pos            int
+}
+
+type queryNotNode struct {
+	x queryNode
+}
+
+type queryBinary struct {
+	op          queryTokenKind
+	left, right queryNode
+}
+
+// ==================== parser ====================
+
+// expr   = term { ("|" | "OR") term }
+// term   = factor { ["&" | "AND"] factor }
+// factor = ("!" | "NOT") factor | "(" expr ")" | TAG | ATTR
+// ATTR   = KEY ("=" | "==" | "!=" | "<" | "<=" | ">" | ">=") VALUE
+type queryParser struct {
+	tokens []queryToken
+	n      int
+}
+
+func parseQuery(expr string) (queryNode, error) {
+	p := &queryParser{tokens: lexQuery(expr)}
+	if p.peek().kind == queryEOF {
+		return nil, &QueryError{0, "式が空です"}
+	}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != queryEOF {
+		return nil, &QueryError{tok.pos, tok.text + " 予期しない文字です"}
+	}
+	return node, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.n]
+}
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.n]
+	if tok.kind != queryEOF {
+		p.n++
+	}
+	return tok
+}
+
+func (p *queryParser) parseExpr() (queryNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == queryOr {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryBinary{queryOr, left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseTerm() (queryNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case queryAnd:
+			p.next()
+		case queryIdent, queryAttr, queryNot, queryLParen:
+			// 演算子の省略はANDとして扱う
+		default:
+			return left, nil
+		}
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryBinary{queryAnd, left, right}
+	}
+}
+
+func (p *queryParser) parseFactor() (queryNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case queryNot:
+		x, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNotNode{x}, nil
+	case queryLParen:
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != queryRParen {
+			return nil, &QueryError{closing.pos, "対応する ) がありません"}
+		}
+		return x, nil
+	case queryIdent:
+		return &queryTag{tok.text, tok.pos}, nil
+	case queryAttr:
+		return parseQueryAttr(tok)
+	}
+	return nil, &QueryError{tok.pos, tok.kind.String() + " の位置にタグ名が必要です"}
+}
+
+func parseQueryAttr(tok queryToken) (queryNode, error) {
+	n := strings.IndexAny(tok.text, "=<>!")
+	rest := tok.text[n:]
+	op := ""
+	for _, v := range attrOperators {
+		if strings.HasPrefix(rest, v) {
+			op = v
+			break
+		}
+	}
+	node := &queryAttrNode{tok.text[:n], op, rest[len(op):], tok.pos}
+	if err := checkAttrKey(node.key); err != nil {
+		return nil, &QueryError{tok.pos, err.Error()}
+	}
+	if op == "" || node.value == "" || strings.ContainsAny(node.value[:1], "=<>") {
+		return nil, &QueryError{tok.pos, tok.text + " 比較の形式が正しくありません(例: priority>=2)"}
+	}
+	return node, nil
+}
+
+// ==================== evaluator ====================
+
+func (n *queryTag) eval(t *Tager, recursive bool) ([]string, error) {
+	files, err := t.getFiles(n.name, recursive)
+	if err != nil {
+		return nil, &QueryError{n.pos, err.Error()}
+	}
+	return uniqueStrings(files...), nil
+}
+
+func (n *queryAttrNode) eval(t *Tager, recursive bool) ([]string, error) {
+	files := make([]string, 0)
+	for _, file := range t.allFiles() {
+		if t.fileAttrMatches(file, n.key, n.op, n.value) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (n *queryNotNode) eval(t *Tager, recursive bool) ([]string, error) {
+	x, err := n.x.eval(t, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return subStrings(t.allFiles(), x), nil
+}
+
+func (n *queryBinary) eval(t *Tager, recursive bool) ([]string, error) {
+	left, err := n.left.eval(t, recursive)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(t, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == queryOr {
+		return uniqueStrings(append(left, right...)...), nil
+	}
+	return andStrings(left, right), nil
+}
+
+// 論理式でファイルを検索する
+// 複数の引数は空白で連結されるので、並べたタグはAND計算になる
+func (t *Tager) getFilesQuery(recursive bool, exprs ...string) ([]string, error) {
+	node, err := parseQuery(strings.Join(exprs, " "))
+	if err != nil {
+		return nil, err
+	}
+	return node.eval(t, recursive)
+}
+
+// 論理式に含まれるタグ名を置き換える
+func renameQueryTag(expr, old, new string) string {
+	return renameQueryTags(expr, map[string]string{old: new})
+}
+
+// 論理式に含まれるタグ名を names に従って置き換える
+// parent/child の形式のタグは / で区切ったそれぞれを置き換える
+// 一度に置き換えるので、a -> b と b -> c を同時に指定しても a が c にはならない
+func renameQueryTags(expr string, names map[string]string) string {
+	rs := []rune(expr)
+	result := make([]rune, 0, len(rs))
+	last := 0
+	for _, tok := range lexQuery(expr) {
+		if tok.kind != queryIdent {
+			continue
+		}
+		segs := strings.Split(tok.text, "/")
+		changed := false
+		for n, seg := range segs {
+			if name, ok := names[seg]; ok {
+				segs[n] = name
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		result = append(result, rs[last:tok.pos]...)
+		result = append(result, []rune(strings.Join(segs, "/"))...)
+		last = tok.pos + len([]rune(tok.text))
+	}
+	result = append(result, rs[last:]...)
+	return string(result)
+}
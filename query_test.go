@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 構文木を括弧付きの式にする
+func queryString(n queryNode) string {
+	switch n := n.(type) {
+	case *queryTag:
+		return n.name
+	case *queryAttrNode:
+		return n.key + n.op + n.value
+	case *queryNotNode:
+		return "!" + queryString(n.x)
+	case *queryBinary:
+		op := "&"
+		if n.op == queryOr {
+			op = "|"
+		}
+		return "(" + queryString(n.left) + " " + op + " " + queryString(n.right) + ")"
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"a", "a"},
+		// & は | より優先される
+		{"a | b & c", "(a | (b & c))"},
+		{"a & b | c", "((a & b) | c)"},
+		{"(a | b) & c", "((a | b) & c)"},
+		{"a | b | c", "((a | b) | c)"},
+		// 演算子の省略は AND
+		{"a b", "(a & b)"},
+		{"a b | c", "((a & b) | c)"},
+		{"a (b | c)", "(a & (b | c))"},
+		{"a !b", "(a & !b)"},
+		// ! は直後の要素のみにかかる
+		{"!a & b", "(!a & b)"},
+		{"!!a", "!!a"},
+		{"!(a | b)", "!(a | b)"},
+		{"a AND NOT b OR c", "((a & !b) | c)"},
+		// != は否定ではなく比較
+		{"owner!=alice", "owner!=alice"},
+		{"a & owner!=alice", "(a & owner!=alice)"},
+		{"a owner!=alice", "(a & owner!=alice)"},
+		{"priority>=2 | priority<1", "(priority>=2 | priority<1)"},
+		{"!owner=alice", "!owner=alice"},
+		{"a&b|c", "((a & b) | c)"},
+	}
+	for _, tt := range tests {
+		node, err := parseQuery(tt.expr)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := queryString(node); got != tt.want {
+			t.Errorf("parseQuery(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryError(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"", 0},
+		{"   ", 0},
+		{"a &", 3},
+		{"a & | b", 4},
+		{"(a | b", 6},
+		{"a | b)", 5},
+		{"a & ()", 5},
+		{"!", 1},
+		{"a & priority>", 4},
+		{"a & owner==", 4},
+		// 位置は文字数で数える
+		{"日本語 & (", 7},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.expr)
+		qe, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("parseQuery(%q): err = %v, want *QueryError", tt.expr, err)
+			continue
+		}
+		if qe.Pos != tt.pos {
+			t.Errorf("parseQuery(%q): pos = %d, want %d (%v)", tt.expr, qe.Pos, tt.pos, qe)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [flags]",
+	Short: "HTTP/JSON API サーバーを起動する",
+	Long: `HTTP/JSON API サーバーを起動する
+GUI などから tager を操作するためのサーバーです
+
+  GET    /tags                       タグの一覧
+  POST   /tags                       タグの作成 {"name": "", "query": ""}
+  GET    /tags/TAG                   タグの詳細 (?recursive=1)
+  DELETE /tags/TAG                   タグの削除
+  PUT    /tags/TAG/comment           コメントの登録 {"comment": ""}
+  GET    /tags/TAG/files             ファイルの一覧 (?recursive=1)
+  POST   /tags/TAG/files             ファイルの登録 {"files": []}
+  DELETE /tags/TAG/files?path=FILE   ファイルの登録の解除
+  POST   /tags/TAG/tags              子タグの登録 {"tags": []}
+  DELETE /tags/TAG/tags/CHILD        子タグの登録の解除
+  GET    /files?q=QUERY              論理式でファイルを検索 (?recursive=1)
+  GET    /files/tags?path=FILE       ファイルが登録されているタグ (?recursive=1)
+  POST   /mount                      シンボリックリンク集の作成 {"tag": "", "dir": "", "recursive": false,
+                                     "naming": "", "root": "", "link_type": ""}
+
+エラーは {"error": "..."} で返されます
+レスポンスの ETag を If-Match に指定すると、その後に他のコマンドなどで
+変更されていた場合は 412 で失敗します`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// 他のコマンドが実行できるように、ロックと保存先はリクエストのたびに取得する
+		tager.closeStore()
+		unlockConfig()
+		fmt.Println(*serveFlagAddr, "で待ち受けています")
+		if err := http.ListenAndServe(*serveFlagAddr, &apiServer{tager}); err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+type apiServer struct {
+	t *Tager
+}
+
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func badRequest(err error) error {
+	return &apiError{http.StatusBadRequest, err.Error()}
+}
+
+type apiTag struct {
+	Name      string   `json:"name"`
+	Comment   string   `json:"comment,omitempty"`
+	Query     string   `json:"query,omitempty"`
+	Tags      []string `json:"tags"`
+	Files     []string `json:"files,omitempty"`
+	FileCount int      `json:"file_count"`
+}
+
+// 設定の版
+func (t *Tager) etag() string {
+	sum := sha256.Sum256(t.snapshot)
+	return fmt.Sprintf(`"%x"`, sum[:8])
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer unlock()
+	defer s.t.closeStore()
+	if err := s.t.readConfig(configFile); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if match := r.Header.Get("If-Match"); !readOnly && match != "" && match != "*" && match != s.t.etag() {
+		w.Header().Set("ETag", s.t.etag())
+		writeAPIError(w, &apiError{http.StatusPreconditionFailed, "他の操作で変更されています"})
+		return
+	}
+
+	status, body, err := s.route(r)
+	if err != nil {
+		w.Header().Set("ETag", s.t.etag())
+		writeAPIError(w, err)
+		return
+	}
+	if !readOnly {
+		if err := s.t.saveConfig(); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	w.Header().Set("ETag", s.t.etag())
+	writeJSON(w, status, body)
+}
+
+func (s *apiServer) route(r *http.Request) (int, interface{}, error) {
+	// ?recursive は子タグのファイルやタグも含める
+	recursive := r.URL.Query().Get("recursive") != ""
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	switch {
+	case len(path) == 1 && path[0] == "tags":
+		switch method {
+		case http.MethodGet:
+			return s.listTags(recursive)
+		case http.MethodPost:
+			return s.createTag(r, recursive)
+		}
+	case len(path) == 2 && path[0] == "tags":
+		switch method {
+		case http.MethodGet:
+			return s.getTag(path[1], recursive)
+		case http.MethodDelete:
+			return s.deleteTag(path[1])
+		}
+	case len(path) == 3 && path[0] == "tags" && path[2] == "comment":
+		if method == http.MethodPut {
+			return s.setComment(r, path[1], recursive)
+		}
+	case len(path) == 3 && path[0] == "tags" && path[2] == "files":
+		switch method {
+		case http.MethodGet:
+			return s.tagFiles(path[1], recursive)
+		case http.MethodPost:
+			return s.addFiles(r, path[1], recursive)
+		case http.MethodDelete:
+			return s.removeFiles(r, path[1], recursive)
+		}
+	case len(path) == 3 && path[0] == "tags" && path[2] == "tags":
+		if method == http.MethodPost {
+			return s.addTags(r, path[1], recursive)
+		}
+	case len(path) == 4 && path[0] == "tags" && path[2] == "tags":
+		if method == http.MethodDelete {
+			return s.removeTag(path[1], path[3], recursive)
+		}
+	case len(path) == 1 && path[0] == "files":
+		if method == http.MethodGet {
+			return s.queryFiles(r, recursive)
+		}
+	case len(path) == 2 && path[0] == "files" && path[1] == "tags":
+		if method == http.MethodGet {
+			return s.tagsOfFile(r, recursive)
+		}
+	case len(path) == 1 && path[0] == "mount":
+		if method == http.MethodPost {
+			return s.mount(r)
+		}
+	default:
+		return 0, nil, &apiError{http.StatusNotFound, r.URL.Path + " そのようなAPIはありません"}
+	}
+	return 0, nil, &apiError{http.StatusMethodNotAllowed, r.Method + " は利用できません"}
+}
+
+func (s *apiServer) tagExists(tag string) error {
+	if _, err := s.t.getTag(tag); err != nil {
+		return &apiError{http.StatusNotFound, err.Error()}
+	}
+	return nil
+}
+
+func (s *apiServer) tagInfo(tag string, withFiles, recursive bool) (*apiTag, error) {
+	cur, err := s.t.getTag(tag)
+	if err != nil {
+		return nil, &apiError{http.StatusNotFound, err.Error()}
+	}
+	info := &apiTag{
+		Name: cur.BottomPath().(string),
+		Tags: s.t.childTagNames(cur.BottomPath().(string)),
+	}
+	if cur.HasChild("comment") {
+		info.Comment = cur.Child("comment").ToString()
+	}
+	if cur.HasChild("query") {
+		info.Query = cur.Child("query").ToString()
+	}
+	files, err := s.t.getFiles(tag, recursive)
+	if err != nil {
+		return nil, err
+	}
+	files = uniqueStrings(files...)
+	sort.Strings(files)
+	info.FileCount = len(files)
+	if withFiles {
+		info.Files = files
+	}
+	return info, nil
+}
+
+func (s *apiServer) listTags(recursive bool) (int, interface{}, error) {
+	names := s.t.tagNames()
+	sort.Strings(names)
+	tags := make([]*apiTag, 0)
+	for _, name := range names {
+		info, err := s.tagInfo(name, false, recursive)
+		if err != nil {
+			return 0, nil, err
+		}
+		tags = append(tags, info)
+	}
+	return http.StatusOK, tags, nil
+}
+
+func (s *apiServer) createTag(r *http.Request, recursive bool) (int, interface{}, error) {
+	var req struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if s.t.hasTag(req.Name) {
+		return 0, nil, &apiError{http.StatusConflict, req.Name + " というタグは既に存在しています"}
+	}
+	var err error
+	if req.Query != "" {
+		err = s.t.createQueryTag(req.Name, req.Query)
+	} else {
+		err = s.t.createTag(req.Name)
+	}
+	if err != nil {
+		return 0, nil, badRequest(err)
+	}
+	info, err := s.tagInfo(req.Name, true, recursive)
+	return http.StatusCreated, info, err
+}
+
+func (s *apiServer) getTag(tag string, recursive bool) (int, interface{}, error) {
+	info, err := s.tagInfo(tag, true, recursive)
+	return http.StatusOK, info, err
+}
+
+func (s *apiServer) deleteTag(tag string) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	if err := s.t.deleteTag(tag); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]string{"deleted": tag}, nil
+}
+
+func (s *apiServer) setComment(r *http.Request, tag string, recursive bool) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if err := s.t.setComment(tag, req.Comment); err != nil {
+		return 0, nil, err
+	}
+	return s.getTag(tag, recursive)
+}
+
+func (s *apiServer) tagFiles(tag string, recursive bool) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	files, err := s.t.getFiles(tag, recursive)
+	if err != nil {
+		return 0, nil, err
+	}
+	files = uniqueStrings(files...)
+	sort.Strings(files)
+	return http.StatusOK, files, nil
+}
+
+func (s *apiServer) addFiles(r *http.Request, tag string, recursive bool) (int, interface{}, error) {
+	cur, err := s.t.getTag(tag)
+	if err != nil {
+		return 0, nil, &apiError{http.StatusNotFound, err.Error()}
+	}
+	if cur.HasChild("query") {
+		return 0, nil, &apiError{http.StatusBadRequest, tag + " は論理式タグなのでファイルを登録できません"}
+	}
+	var req struct {
+		Files []string `json:"files"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return 0, nil, err
+	}
+	for _, file := range req.Files {
+		if !filepath.IsAbs(file) {
+			return 0, nil, &apiError{http.StatusBadRequest, file + " ファイルは絶対パスで指定してください"}
+		}
+		if !fileExists(file) {
+			return 0, nil, &apiError{http.StatusBadRequest, file + " そのようなファイルは存在しません"}
+		}
+	}
+	for _, file := range req.Files {
+		if cur.Child("files").HasChild(file) {
+			continue
+		}
+		if err := s.t.registerFile(cur, file, file); err != nil {
+			return 0, nil, err
+		}
+	}
+	return s.tagFiles(tag, recursive)
+}
+
+func (s *apiServer) removeFiles(r *http.Request, tag string, recursive bool) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	for _, file := range r.URL.Query()["path"] {
+		if err := s.t.unregisterFile(tag, file); err != nil {
+			return 0, nil, err
+		}
+	}
+	return s.tagFiles(tag, recursive)
+}
+
+func (s *apiServer) addTags(r *http.Request, tag string, recursive bool) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return 0, nil, err
+	}
+	for _, child := range req.Tags {
+		if err := s.tagExists(child); err != nil {
+			return 0, nil, err
+		}
+		if err := s.t.addChildTag(tag, child); err != nil {
+			return 0, nil, &apiError{http.StatusConflict, err.Error()}
+		}
+	}
+	return s.getTag(tag, recursive)
+}
+
+func (s *apiServer) removeTag(tag, child string, recursive bool) (int, interface{}, error) {
+	if err := s.tagExists(tag); err != nil {
+		return 0, nil, err
+	}
+	if err := s.t.removeChildTag(tag, child); err != nil {
+		return 0, nil, err
+	}
+	return s.getTag(tag, recursive)
+}
+
+func (s *apiServer) queryFiles(r *http.Request, recursive bool) (int, interface{}, error) {
+	q := r.URL.Query().Get("q")
+	files, err := s.t.getFilesQuery(recursive, q)
+	if err != nil {
+		return 0, nil, badRequest(err)
+	}
+	sort.Strings(files)
+	return http.StatusOK, files, nil
+}
+
+func (s *apiServer) tagsOfFile(r *http.Request, recursive bool) (int, interface{}, error) {
+	result := map[string][]string{}
+	for _, file := range r.URL.Query()["path"] {
+		tags, err := s.t.tagsOfFile(file, recursive)
+		if err != nil {
+			return 0, nil, badRequest(err)
+		}
+		sort.Strings(tags)
+		result[file] = tags
+	}
+	return http.StatusOK, result, nil
+}
+
+func (s *apiServer) mount(r *http.Request) (int, interface{}, error) {
+	var req struct {
+		Tag       string `json:"tag"`
+		Dir       string `json:"dir"`
+		Recursive bool   `json:"recursive"`
+		mountOptions
+	}
+	if err := readJSON(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if err := s.tagExists(req.Tag); err != nil {
+		return 0, nil, err
+	}
+	if req.Dir == "" {
+		req.Dir = mountDirName(req.Tag)
+	}
+	errs, err := s.t.mountTag(req.Tag, req.Dir, req.Recursive, req.mountOptions)
+	if err != nil {
+		return 0, nil, badRequest(err)
+	}
+	msgs := make([]string, 0)
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return http.StatusCreated, map[string]interface{}{"dir": req.Dir, "errors": msgs}, nil
+}
+
+// ==================== json ====================
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, "JSON が正しくありません: " + err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type apiClient struct {
+	t   *testing.T
+	url string
+}
+
+// テスト用の設定ファイルで API サーバーを起動する
+func newTestServer(t *testing.T) (*apiClient, string) {
+	dir := t.TempDir()
+	old := configFile
+	configFile = filepath.Join(dir, ".tager", "config.json")
+	t.Cleanup(func() { configFile = old })
+
+	tg := new(Tager)
+	if err := tg.readConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.init(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(&apiServer{tg})
+	t.Cleanup(ts.Close)
+	return &apiClient{t, ts.URL}, dir
+}
+
+// リクエストを送り、ステータスとレスポンスの JSON、ETag を返す
+func (c *apiClient) do(method, path string, body interface{}, header map[string]string) (int, interface{}, string) {
+	c.t.Helper()
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.url+path, r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		c.t.Errorf("%s %s: Content-Type = %q", method, path, ct)
+	}
+	var v interface{}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return res.StatusCode, v, res.Header.Get("ETag")
+}
+
+// 期待したステータスでなければ失敗する
+func (c *apiClient) expect(status int, method, path string, body interface{}) interface{} {
+	c.t.Helper()
+	got, v, _ := c.do(method, path, body, nil)
+	if got != status {
+		c.t.Fatalf("%s %s: status = %d, want %d (%v)", method, path, got, status, v)
+	}
+	return v
+}
+
+// エラーが {"error": "..."} で返されることを確かめる
+func (c *apiClient) expectError(status int, method, path string, body interface{}) {
+	c.t.Helper()
+	v := c.expect(status, method, path, body)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("%s %s: %v is not an error object", method, path, v)
+	}
+	if msg, _ := m["error"].(string); msg == "" {
+		c.t.Fatalf("%s %s: error is empty: %v", method, path, v)
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(name), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func strs(v interface{}) []string {
+	ss := make([]string, 0)
+	list, _ := v.([]interface{})
+	for _, s := range list {
+		ss = append(ss, s.(string))
+	}
+	return ss
+}
+
+func field(v interface{}, name string) interface{} {
+	m, _ := v.(map[string]interface{})
+	return m[name]
+}
+
+func TestServerTags(t *testing.T) {
+	c, _ := newTestServer(t)
+
+	if v := c.expect(http.StatusOK, "GET", "/tags", nil); len(v.([]interface{})) != 0 {
+		t.Fatalf("tags = %v, want empty", v)
+	}
+	v := c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "music"})
+	if field(v, "name") != "music" {
+		t.Fatalf("created = %v", v)
+	}
+	c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "rock"})
+	c.expectError(http.StatusConflict, "POST", "/tags", map[string]string{"name": "music"})
+	c.expectError(http.StatusBadRequest, "POST", "/tags", map[string]string{"name": "a/b"})
+
+	v = c.expect(http.StatusOK, "GET", "/tags", nil)
+	names := make([]string, 0)
+	for _, tag := range v.([]interface{}) {
+		names = append(names, field(tag, "name").(string))
+	}
+	if want := []string{"music", "rock"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("tags = %v, want %v", names, want)
+	}
+
+	v = c.expect(http.StatusOK, "PUT", "/tags/music/comment", map[string]string{"comment": "音楽"})
+	if field(v, "comment") != "音楽" {
+		t.Fatalf("comment = %v", field(v, "comment"))
+	}
+	if v := c.expect(http.StatusOK, "GET", "/tags/music", nil); field(v, "comment") != "音楽" {
+		t.Fatalf("comment is not saved: %v", v)
+	}
+
+	v = c.expect(http.StatusOK, "POST", "/tags/music/tags", map[string][]string{"tags": {"rock"}})
+	if got := strs(field(v, "tags")); !reflect.DeepEqual(got, []string{"rock"}) {
+		t.Fatalf("child tags = %v", got)
+	}
+	c.expectError(http.StatusNotFound, "POST", "/tags/music/tags", map[string][]string{"tags": {"jazz"}})
+	v = c.expect(http.StatusOK, "DELETE", "/tags/music/tags/rock", nil)
+	if got := strs(field(v, "tags")); len(got) != 0 {
+		t.Fatalf("child tags = %v, want empty", got)
+	}
+
+	c.expect(http.StatusOK, "DELETE", "/tags/rock", nil)
+	c.expectError(http.StatusNotFound, "GET", "/tags/rock", nil)
+	c.expectError(http.StatusNotFound, "DELETE", "/tags/rock", nil)
+}
+
+func TestServerFiles(t *testing.T) {
+	c, dir := newTestServer(t)
+	a := writeTestFile(t, dir, "a.txt")
+	b := writeTestFile(t, dir, "b.txt")
+
+	c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "music"})
+	c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "rock"})
+	c.expect(http.StatusOK, "POST", "/tags/music/tags", map[string][]string{"tags": {"rock"}})
+
+	v := c.expect(http.StatusOK, "POST", "/tags/music/files", map[string][]string{"files": {a}})
+	if got := strs(v); !reflect.DeepEqual(got, []string{a}) {
+		t.Fatalf("files = %v", got)
+	}
+	c.expect(http.StatusOK, "POST", "/tags/rock/files", map[string][]string{"files": {b}})
+	c.expectError(http.StatusBadRequest, "POST", "/tags/music/files", map[string][]string{"files": {"a.txt"}})
+	c.expectError(http.StatusBadRequest, "POST", "/tags/music/files", map[string][]string{"files": {filepath.Join(dir, "none")}})
+	c.expectError(http.StatusNotFound, "POST", "/tags/jazz/files", map[string][]string{"files": {a}})
+
+	if got := strs(c.expect(http.StatusOK, "GET", "/tags/music/files", nil)); !reflect.DeepEqual(got, []string{a}) {
+		t.Fatalf("files = %v", got)
+	}
+	if got := strs(c.expect(http.StatusOK, "GET", "/tags/music/files?recursive=1", nil)); !reflect.DeepEqual(got, []string{a, b}) {
+		t.Fatalf("recursive files = %v", got)
+	}
+	v = c.expect(http.StatusOK, "GET", "/tags/music?recursive=1", nil)
+	if field(v, "file_count") != float64(2) {
+		t.Fatalf("file_count = %v, want 2", field(v, "file_count"))
+	}
+
+	v = c.expect(http.StatusOK, "GET", "/files/tags?path="+url.QueryEscape(b)+"&recursive=1", nil)
+	if got := strs(field(v, b)); !reflect.DeepEqual(got, []string{"music", "rock"}) {
+		t.Fatalf("tags of %s = %v", b, got)
+	}
+
+	v = c.expect(http.StatusOK, "DELETE", "/tags/music/files?path="+url.QueryEscape(a), nil)
+	if got := strs(v); len(got) != 0 {
+		t.Fatalf("files = %v, want empty", got)
+	}
+	v = c.expect(http.StatusOK, "GET", "/files/tags?path="+url.QueryEscape(a), nil)
+	if got := strs(field(v, a)); len(got) != 0 {
+		t.Fatalf("tags of %s = %v, want empty", a, got)
+	}
+}
+
+func TestServerQuery(t *testing.T) {
+	c, dir := newTestServer(t)
+	a := writeTestFile(t, dir, "a.txt")
+	b := writeTestFile(t, dir, "b.txt")
+
+	c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "music"})
+	c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "rock"})
+	c.expect(http.StatusOK, "POST", "/tags/music/files", map[string][]string{"files": {a, b}})
+	c.expect(http.StatusOK, "POST", "/tags/rock/files", map[string][]string{"files": {b}})
+
+	v := c.expect(http.StatusOK, "GET", "/files?q="+url.QueryEscape("music & !rock"), nil)
+	if got := strs(v); !reflect.DeepEqual(got, []string{a}) {
+		t.Fatalf("music & !rock = %v", got)
+	}
+	c.expectError(http.StatusBadRequest, "GET", "/files?q="+url.QueryEscape("music & ("), nil)
+
+	v = c.expect(http.StatusCreated, "POST", "/tags", map[string]string{"name": "both", "query": "music & rock"})
+	if field(v, "query") != "music & rock" {
+		t.Fatalf("query = %v", field(v, "query"))
+	}
+	if got := strs(c.expect(http.StatusOK, "GET", "/tags/both/files", nil)); !reflect.DeepEqual(got, []string{b}) {
+		t.Fatalf("files of both = %v", got)
+	}
+	c.expectError(http.StatusBadRequest, "POST", "/tags/both/files", map[string][]string{"files": {a}})
+}
+
+func TestServerErrors(t *testing.T) {
+	c, _ := newTestServer(t)
+
+	c.expectError(http.StatusNotFound, "GET", "/nothing", nil)
+	c.expectError(http.StatusMethodNotAllowed, "PATCH", "/tags", nil)
+	c.expectError(http.StatusNotFound, "GET", "/tags/none", nil)
+
+	status, v, _ := c.do("POST", "/tags", nil, nil)
+	if status != http.StatusBadRequest || field(v, "error") == nil {
+		t.Fatalf("empty body: status = %d, body = %v", status, v)
+	}
+}
+
+func TestServerETag(t *testing.T) {
+	c, _ := newTestServer(t)
+
+	_, _, etag := c.do("GET", "/tags", nil, nil)
+	if etag == "" {
+		t.Fatal("ETag is empty")
+	}
+	status, _, etag2 := c.do("POST", "/tags", map[string]string{"name": "music"}, map[string]string{"If-Match": etag})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", status, http.StatusCreated)
+	}
+	if etag2 == etag {
+		t.Fatal("ETag is not changed after a write")
+	}
+
+	// 他のコマンドが設定ファイルを書き換えた場合
+	other := new(Tager)
+	if err := other.readConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.createTag("rock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, v, etag3 := c.do("POST", "/tags", map[string]string{"name": "jazz"}, map[string]string{"If-Match": etag2})
+	if status != http.StatusPreconditionFailed || field(v, "error") == nil {
+		t.Fatalf("status = %d, body = %v, want %d", status, v, http.StatusPreconditionFailed)
+	}
+	if etag3 == etag2 {
+		t.Fatal("412 response should carry the current ETag")
+	}
+	c.expectError(http.StatusNotFound, "GET", "/tags/jazz", nil)
+
+	status, _, _ = c.do("POST", "/tags", map[string]string{"name": "jazz"}, map[string]string{"If-Match": etag3})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d with the current ETag, want %d", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/intelfike/nestmap"
+	"github.com/spf13/cobra"
+)
+
+// タグとファイルの情報の保存先
+// config.json の root.store で選択する
+//
+//	json   config.json の root.tags に保存する(既定)
+//	bolt   config.json と同じディレクトリの tags.db に保存する
+//	shard  config.json と同じディレクトリの tags/ にタグごとに保存する
+type Store interface {
+	GetTag(name string) (*TagData, error)
+	PutTag(tag *TagData) error
+	DeleteTag(name string) error
+	ListTags() ([]string, error)
+	FilesOf(tag string) ([]string, error)
+	TagsOf(file string) ([]string, error)
+	// 索引から、タグを読み込まずに答える
+	// ファイル -> 登録されているタグ
+	FileIndex() (map[string][]string, error)
+	// タグ -> 子タグと論理式
+	TagIndex() (map[string]TagSummary, error)
+	// ファイルの情報 root.files.<file>
+	// 情報がない場合は nil を返す
+	GetFile(file string) (json.RawMessage, error)
+	PutFile(file string, meta json.RawMessage) error
+	DeleteFile(file string) error
+	ListFiles() ([]string, error)
+	// fn 内の変更をまとめて保存する
+	Tx(fn func(s Store) error) error
+	Close() error
+}
+
+// ひとつのタグのデータ
+// root.tags.<Name> と同じ形式
+type TagData struct {
+	Name    string            `json:"-"`
+	Comment string            `json:"comment,omitempty"`
+	Query   string            `json:"query,omitempty"`
+	Files   map[string]string `json:"files,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	// 上記以外のキー(消さずにそのまま保存する)
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// TagData のフィールドになっているキー
+var tagDataKeys = []string{"comment", "query", "files", "tags", "attrs"}
+
+type plainTagData TagData
+
+func (d *TagData) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*plainTagData)(d)); err != nil {
+		return err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, key := range tagDataKeys {
+		delete(m, key)
+	}
+	d.Extra = nil
+	if len(m) != 0 {
+		d.Extra = m
+	}
+	return nil
+}
+
+func (d *TagData) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal((*plainTagData)(d))
+	if err != nil || len(d.Extra) == 0 {
+		return b, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range d.Extra {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return json.Marshal(m)
+}
+
+// 索引に保存するタグの概要
+type TagSummary struct {
+	Tags    []string `json:"tags,omitempty"`
+	Query   string   `json:"query,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+func summaryOf(tag *TagData) TagSummary {
+	sum := TagSummary{Query: tag.Query, Comment: tag.Comment}
+	for child := range tag.Tags {
+		sum.Tags = append(sum.Tags, child)
+	}
+	sort.Strings(sum.Tags)
+	return sum
+}
+
+var errTagNotFound = errors.New("そのようなタグは存在しません")
+
+var storeCmd = &cobra.Command{
+	Use:   "store [json|bolt|shard]",
+	Short: "タグの保存先を表示、変更する",
+	Long: `タグの保存先を表示、変更する
+  json   config.json に保存する(既定)
+  bolt   tags.db に保存する
+         変更されたタグのみ書き込むので、タグやファイルが多い場合に向いています
+  shard  tags/ ディレクトリにタグごとのファイルとして保存する
+         git でタグを共有する場合に向いています(tager merge-driver -h を参照)
+ファイルの属性や inode、ハッシュなどの情報も同じ保存先に保存されます
+(shard の場合は files/ と local/files/ に保存されます)
+タグの内容やファイルの情報は、使われたときに読み込まれます
+変更した場合は、現在のタグとファイルの情報がすべて新しい保存先に移されます`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Println(storeKind(tager.config))
+			return
+		}
+		if len(args) != 1 {
+			cmd.Help()
+			return
+		}
+		if err := tager.changeStore(args[0]); err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+func storeKind(config *nestmap.Nestmap) string {
+	if !config.HasChild("root", "store") {
+		return "json"
+	}
+	return config.Child("root", "store").ToString()
+}
+
+func (t *Tager) openStore(kind string) (Store, error) {
+	switch kind {
+	case "json":
+		return &jsonStore{t}, nil
+	case "bolt":
+		return openBoltStore(filepath.Join(filepath.Dir(configFile), "tags.db"))
+	case "shard":
+		return openShardStore(filepath.Join(filepath.Dir(configFile), "tags"))
+	}
+	return nil, errors.New(kind + " そのような保存先はありません")
+}
+
+// 保存先を変更し、すべてのタグとファイルの情報を移す
+func (t *Tager) changeStore(kind string) error {
+	if kind == storeKind(t.config) {
+		return nil
+	}
+	if err := t.loadAllTags(); err != nil {
+		return err
+	}
+	if err := t.loadAllFiles(); err != nil {
+		return err
+	}
+	store, err := t.openStore(kind)
+	if err != nil {
+		return err
+	}
+	t.store.Close()
+	t.store = store
+	t.tagSummaries = nil
+	// 移し先に既にあるタグやファイルの情報は、すべて書き換えるか削除する
+	t.storedTags = map[string]string{}
+	t.storedFiles = map[string]string{}
+	if _, ok := store.(*jsonStore); !ok {
+		names, err := store.ListTags()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			t.storedTags[name] = ""
+		}
+		files, err := store.ListFiles()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			t.storedFiles[t.absPath(file)] = staleFile
+		}
+	}
+	t.config.Child("root", "store").Set(kind)
+	return t.saveConfig()
+}
+
+// 保存先を閉じる
+// bolt は開いている間 tags.db をロックするので、常駐するコマンドは操作のたびに閉じる
+// 次に使うときは readConfig で開き直す
+func (t *Tager) closeStore() {
+	if t.store != nil {
+		t.store.Close()
+		t.store = nil
+	}
+}
+
+// store のタグの一覧を読み込む
+// タグの内容は、使われたときに loadTag で root.tags に読み込む
+func (t *Tager) loadTags() error {
+	t.storedTags = map[string]string{}
+	t.unloadedTags = map[string]bool{}
+	t.storedFiles = map[string]string{}
+	t.tagSummaries = nil
+	if _, ok := t.store.(*jsonStore); ok {
+		return nil
+	}
+	t.rootTags.Set(map[string]interface{}{})
+	names, err := t.store.ListTags()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t.unloadedTags[name] = true
+	}
+	return nil
+}
+
+// store のタグを root.tags に読み込む
+func (t *Tager) loadTag(name string) error {
+	if !t.unloadedTags[name] {
+		return nil
+	}
+	delete(t.unloadedTags, name)
+	data, err := t.store.GetTag(name)
+	if err != nil {
+		return errors.New(name + " タグを読み込めませんでした: " + err.Error())
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	stored := string(b)
+	convertTagPaths(data, t.absPath)
+	b, err = json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	t.rootTags.Child(name).Set(v)
+	t.storedTags[name] = stored
+	return nil
+}
+
+func (t *Tager) loadAllTags() error {
+	for _, name := range t.tagNames() {
+		if err := t.loadTag(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// root.tags.<name>
+// まだ読み込んでいないタグは store から読み込む
+func (t *Tager) tagNode(name string) *nestmap.Nestmap {
+	if err := t.loadTag(name); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return t.rootTags.Child(name)
+}
+
+// タグが存在するか(タグの内容は読み込まない)
+func (t *Tager) hasTag(name string) bool {
+	return t.unloadedTags[name] || t.rootTags.HasChild(name)
+}
+
+// すべてのタグの名前(タグの内容は読み込まない)
+func (t *Tager) tagNames() []string {
+	names := t.rootTags.Keys()
+	for name := range t.unloadedTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 読み込み済みのタグか
+// 読み込み済みのタグはメモリ上の内容が、それ以外は store の内容が最新になる
+func (t *Tager) tagLoaded(name string) bool {
+	return !t.unloadedTags[name]
+}
+
+// 読み込んでいないタグの子タグと論理式(store の索引から読む)
+func (t *Tager) tagSummary(name string) TagSummary {
+	if t.tagSummaries == nil {
+		index, err := t.store.TagIndex()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			index = map[string]TagSummary{}
+		}
+		t.tagSummaries = index
+	}
+	return t.tagSummaries[name]
+}
+
+// 子タグの名前(タグの内容は読み込まない)
+func (t *Tager) childTagNames(tag string) []string {
+	if !t.tagLoaded(tag) {
+		return append([]string{}, t.tagSummary(tag).Tags...)
+	}
+	return t.childKeys(t.tagNode(tag), "tags")
+}
+
+// タグのコメント(タグの内容は読み込まない)
+func (t *Tager) tagComment(tag string) string {
+	if !t.tagLoaded(tag) {
+		return t.tagSummary(tag).Comment
+	}
+	cur := t.tagNode(tag)
+	if !cur.HasChild("comment") {
+		return ""
+	}
+	return cur.Child("comment").ToString()
+}
+
+// 論理式タグか(タグの内容は読み込まない)
+func (t *Tager) isQueryTag(tag string) bool {
+	if !t.tagLoaded(tag) {
+		return t.tagSummary(tag).Query != ""
+	}
+	return t.tagNode(tag).HasChild("query")
+}
+
+// root.tags の変更を store に書き込む
+// 読み込んでいないタグは変更されていないので書き込まない
+func (t *Tager) syncTags() error {
+	return t.store.Tx(func(s Store) error {
+		for name := range t.storedTags {
+			if t.rootTags.HasChild(name) {
+				continue
+			}
+			if err := s.DeleteTag(name); err != nil {
+				return err
+			}
+			delete(t.storedTags, name)
+		}
+		for _, name := range t.rootTags.Keys() {
+			data, err := tagDataOf(name, t.rootTags.Child(name))
+			if err != nil {
+				return err
+			}
+			convertTagPaths(data, t.relPath)
+			b, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			if t.storedTags[name] == string(b) {
+				continue
+			}
+			if err := s.PutTag(data); err != nil {
+				return err
+			}
+			t.storedTags[name] = string(b)
+		}
+		return nil
+	})
+}
+
+// ==================== file ====================
+
+// 保存先の変更時に、移し先に既にあったファイルの情報を表す
+// どの JSON とも一致しないので、必ず書き換えるか削除される
+const staleFile = "-"
+
+// store のファイルの情報を root.files に読み込む
+// json 以外の保存先では、root.files には使われたファイルの分だけ読み込む
+func (t *Tager) loadFile(full string) error {
+	if _, ok := t.store.(*jsonStore); ok {
+		return nil
+	}
+	if _, ok := t.storedFiles[full]; ok {
+		return nil
+	}
+	// 以前の版で config.json に保存されていたものは、そのまま使い store に移す
+	if t.fileMetas().HasChild(full) {
+		return nil
+	}
+	t.storedFiles[full] = ""
+	b, err := t.store.GetFile(t.relPath(full))
+	if err != nil {
+		return errors.New(full + " ファイルの情報を読み込めませんでした: " + err.Error())
+	}
+	if b == nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return errors.New(full + " ファイルの情報を読み込めませんでした: " + err.Error())
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return err
+	}
+	t.fileMetas().Child(full).Set(v)
+	t.storedFiles[full] = string(b)
+	return nil
+}
+
+func (t *Tager) loadAllFiles() error {
+	if _, ok := t.store.(*jsonStore); ok {
+		return nil
+	}
+	files, err := t.store.ListFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := t.loadFile(t.absPath(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// root.files の変更を store に書き込む
+// 読み込んでいないファイルの情報は変更されていないので書き込まない
+func (t *Tager) syncFiles() error {
+	files := t.fileMetas().Keys()
+	for full := range t.storedFiles {
+		if !t.fileMetas().HasChild(full) {
+			files = append(files, full)
+		}
+	}
+	return t.store.Tx(func(s Store) error {
+		for _, full := range files {
+			stored := t.storedFiles[full]
+			if !t.fileMetas().HasChild(full) {
+				if stored != "" {
+					if err := s.DeleteFile(t.relPath(full)); err != nil {
+						return err
+					}
+				}
+				t.storedFiles[full] = ""
+				continue
+			}
+			b, err := t.fileMetas().Child(full).BytesIndent()
+			if err != nil {
+				return err
+			}
+			var v interface{}
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			if b, err = json.Marshal(v); err != nil {
+				return err
+			}
+			if stored == string(b) {
+				continue
+			}
+			if err := s.PutFile(t.relPath(full), b); err != nil {
+				return err
+			}
+			t.storedFiles[full] = string(b)
+		}
+		return nil
+	})
+}
+
+func tagDataOf(name string, cur *nestmap.Nestmap) (*TagData, error) {
+	b, err := cur.BytesIndent()
+	if err != nil {
+		return nil, err
+	}
+	data := new(TagData)
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, err
+	}
+	data.Name = name
+	return data, nil
+}
+
+// ==================== json ====================
+
+// config.json の root.tags をそのまま使う
+// 変更は saveConfig で config.json ごと保存される
+type jsonStore struct {
+	t *Tager
+}
+
+func (s *jsonStore) GetTag(name string) (*TagData, error) {
+	if !s.t.rootTags.HasChild(name) {
+		return nil, errTagNotFound
+	}
+	return tagDataOf(name, s.t.rootTags.Child(name))
+}
+
+func (s *jsonStore) PutTag(tag *TagData) error {
+	b, err := json.Marshal(tag)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	s.t.rootTags.Child(tag.Name).Set(v)
+	return nil
+}
+
+func (s *jsonStore) DeleteTag(name string) error {
+	s.t.rootTags.Child(name).Remove()
+	return nil
+}
+
+func (s *jsonStore) ListTags() ([]string, error) {
+	names := s.t.rootTags.Keys()
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *jsonStore) FilesOf(tag string) ([]string, error) {
+	if !s.t.rootTags.HasChild(tag) {
+		return nil, errTagNotFound
+	}
+	return s.t.childKeys(s.t.rootTags.Child(tag), "files"), nil
+}
+
+func (s *jsonStore) TagsOf(file string) ([]string, error) {
+	tags := make([]string, 0)
+	for _, tag := range s.t.rootTags.Keys() {
+		if s.t.rootTags.Child(tag).HasChild("files") && s.t.rootTags.Child(tag, "files").HasChild(file) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+func (s *jsonStore) FileIndex() (map[string][]string, error) {
+	index := map[string][]string{}
+	for _, tag := range s.t.rootTags.Keys() {
+		for _, file := range s.t.childKeys(s.t.rootTags.Child(tag), "files") {
+			index[file] = append(index[file], tag)
+		}
+	}
+	return index, nil
+}
+
+func (s *jsonStore) TagIndex() (map[string]TagSummary, error) {
+	index := map[string]TagSummary{}
+	for _, tag := range s.t.rootTags.Keys() {
+		data, err := tagDataOf(tag, s.t.rootTags.Child(tag))
+		if err != nil {
+			return nil, err
+		}
+		index[tag] = summaryOf(data)
+	}
+	return index, nil
+}
+
+func (s *jsonStore) GetFile(file string) (json.RawMessage, error) {
+	if !s.t.fileMetas().HasChild(file) {
+		return nil, nil
+	}
+	return s.t.fileMetas().Child(file).BytesIndent()
+}
+
+func (s *jsonStore) PutFile(file string, meta json.RawMessage) error {
+	var v interface{}
+	if err := json.Unmarshal(meta, &v); err != nil {
+		return err
+	}
+	s.t.fileMetas().Child(file).Set(v)
+	return nil
+}
+
+func (s *jsonStore) DeleteFile(file string) error {
+	s.t.fileMetas().Child(file).Remove()
+	return nil
+}
+
+func (s *jsonStore) ListFiles() ([]string, error) {
+	files := s.t.fileMetas().Keys()
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *jsonStore) Tx(fn func(s Store) error) error {
+	return fn(s)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
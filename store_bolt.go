@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltTagsBucket  = []byte("tags")
+	boltFilesBucket = []byte("files")
+	boltIndexBucket = []byte("index")
+	boltMetaBucket  = []byte("meta")
+)
+
+// 組み込みのキーバリューストアに保存する
+//
+//	tags   タグ名 -> TagData
+//	files  ファイル -> 登録されているタグ名の一覧
+//	index  タグ名 -> TagSummary(子タグと論理式)
+//	meta   ファイル -> ファイルの情報(root.files.<file>)
+type boltStore struct {
+	db *bolt.DB
+	// Tx の実行中のみ
+	tx *bolt.Tx
+}
+
+func openBoltStore(filename string) (*boltStore, error) {
+	db, err := bolt.Open(filename, 0766, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltTagsBucket, boltFilesBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltIndexBucket) != nil {
+			return nil
+		}
+		// 索引がない以前の版の tags.db では、タグから作る
+		index, err := tx.CreateBucket(boltIndexBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTagsBucket).ForEach(func(k, v []byte) error {
+			tag := new(TagData)
+			if err := json.Unmarshal(v, tag); err != nil {
+				return err
+			}
+			b, err := json.Marshal(summaryOf(tag))
+			if err != nil {
+				return err
+			}
+			return index.Put(k, b)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+func (s *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.Update(fn)
+}
+
+func (s *boltStore) GetTag(name string) (*TagData, error) {
+	data := new(TagData)
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTagsBucket).Get([]byte(name))
+		if b == nil {
+			return errTagNotFound
+		}
+		return json.Unmarshal(b, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data.Name = name
+	return data, nil
+}
+
+func (s *boltStore) PutTag(tag *TagData) error {
+	b, err := json.Marshal(tag)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		if err := s.unindex(tx, tag.Name); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltTagsBucket).Put([]byte(tag.Name), b); err != nil {
+			return err
+		}
+		sum, err := json.Marshal(summaryOf(tag))
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltIndexBucket).Put([]byte(tag.Name), sum); err != nil {
+			return err
+		}
+		for file := range tag.Files {
+			tags, err := boltTagsOf(tx, file)
+			if err != nil {
+				return err
+			}
+			if err := boltPutTagsOf(tx, file, uniqueStrings(append(tags, tag.Name)...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) DeleteTag(name string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if err := s.unindex(tx, name); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltIndexBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltTagsBucket).Delete([]byte(name))
+	})
+}
+
+// タグに登録されていたファイルの索引からタグを取り除く
+func (s *boltStore) unindex(tx *bolt.Tx, name string) error {
+	b := tx.Bucket(boltTagsBucket).Get([]byte(name))
+	if b == nil {
+		return nil
+	}
+	old := new(TagData)
+	if err := json.Unmarshal(b, old); err != nil {
+		return err
+	}
+	for file := range old.Files {
+		tags, err := boltTagsOf(tx, file)
+		if err != nil {
+			return err
+		}
+		if err := boltPutTagsOf(tx, file, subStrings(tags, []string{name})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) ListTags() ([]string, error) {
+	names := make([]string, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTagsBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+func (s *boltStore) FilesOf(tag string) ([]string, error) {
+	data, err := s.GetTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(data.Files))
+	for file := range data.Files {
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (s *boltStore) TagsOf(file string) ([]string, error) {
+	var tags []string
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		tags, err = boltTagsOf(tx, file)
+		return err
+	})
+	return tags, err
+}
+
+func (s *boltStore) FileIndex() (map[string][]string, error) {
+	index := map[string][]string{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFilesBucket).ForEach(func(k, v []byte) error {
+			tags := make([]string, 0)
+			if err := json.Unmarshal(v, &tags); err != nil {
+				return err
+			}
+			index[string(k)] = tags
+			return nil
+		})
+	})
+	return index, err
+}
+
+func (s *boltStore) TagIndex() (map[string]TagSummary, error) {
+	index := map[string]TagSummary{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIndexBucket).ForEach(func(k, v []byte) error {
+			var sum TagSummary
+			if err := json.Unmarshal(v, &sum); err != nil {
+				return err
+			}
+			index[string(k)] = sum
+			return nil
+		})
+	})
+	return index, err
+}
+
+func (s *boltStore) GetFile(file string) (json.RawMessage, error) {
+	var meta json.RawMessage
+	err := s.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltMetaBucket).Get([]byte(file)); b != nil {
+			// b はトランザクションの外では使えないのでコピーする
+			meta = append(json.RawMessage{}, b...)
+		}
+		return nil
+	})
+	return meta, err
+}
+
+func (s *boltStore) PutFile(file string, meta json.RawMessage) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put([]byte(file), meta)
+	})
+}
+
+func (s *boltStore) DeleteFile(file string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Delete([]byte(file))
+	})
+}
+
+func (s *boltStore) ListFiles() ([]string, error) {
+	files := make([]string, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).ForEach(func(k, v []byte) error {
+			files = append(files, string(k))
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (s *boltStore) Tx(fn func(s Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltStore{db: s.db, tx: tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func boltTagsOf(tx *bolt.Tx, file string) ([]string, error) {
+	tags := make([]string, 0)
+	b := tx.Bucket(boltFilesBucket).Get([]byte(file))
+	if b == nil {
+		return tags, nil
+	}
+	err := json.Unmarshal(b, &tags)
+	return tags, err
+}
+
+func boltPutTagsOf(tx *bolt.Tx, file string, tags []string) error {
+	if len(tags) == 0 {
+		return tx.Bucket(boltFilesBucket).Delete([]byte(file))
+	}
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltFilesBucket).Put([]byte(file), b)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// タグごとに1つの JSON ファイルに保存する
+// キーが整列され、変更したタグのファイルのみ書き換わるので、git で共有しやすい
+//
+//	.tager/tags/<タグ名>.json
+//	.tager/tags/.index.json        索引(マシンごとに作り直す)
+//	.tager/files/<xx>.json         ファイルの属性(ファイル名のハッシュの先頭2文字ごと)
+//	.tager/local/files/<xx>.json   ファイルの inode やハッシュなど、マシンごとに異なる情報
+type shardStore struct {
+	dir      string
+	filesDir string
+	localDir string
+	// 索引(使われたときに読み込む)
+	index map[string]*shardIndexEntry
+	// ファイル -> 登録されているタグ(索引から作る)
+	fileTags map[string][]string
+	// 読み込んだファイルの情報
+	metas map[string]*shardMetas
+	// Tx の実行中は、索引やファイルの情報を最後にまとめて書き込む
+	inTx       bool
+	indexDirty bool
+}
+
+// 索引の1タグ分
+// タグのファイルのサイズと更新日時が変わっていれば作り直す
+type shardIndexEntry struct {
+	Size    int64    `json:"size"`
+	Mtime   int64    `json:"mtime"`
+	Files   []string `json:"files,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Query   string   `json:"query,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+// ファイルの情報の1ファイル分
+type shardMetas struct {
+	shared map[string]map[string]json.RawMessage
+	local  map[string]map[string]json.RawMessage
+	dirty  bool
+}
+
+func openShardStore(dir string) (*shardStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	base := filepath.Dir(dir)
+	return &shardStore{
+		dir:      dir,
+		filesDir: filepath.Join(base, "files"),
+		localDir: filepath.Join(base, "local", "files"),
+		metas:    map[string]*shardMetas{},
+	}, nil
+}
+
+// タグ名をファイル名にする
+// . で始まるファイル名にならないようにエスケープする
+func (s *shardStore) filename(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return filepath.Join(s.dir, escaped+".json")
+}
+
+func (s *shardStore) indexFile() string {
+	return filepath.Join(s.dir, ".index.json")
+}
+
+// 一時ファイルに書き込んでから置き換える
+func writeShardFile(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func (s *shardStore) GetTag(name string) (*TagData, error) {
+	b, err := ioutil.ReadFile(s.filename(name))
+	if os.IsNotExist(err) {
+		return nil, errTagNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := new(TagData)
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, err
+	}
+	data.Name = name
+	return data, nil
+}
+
+func (s *shardStore) PutTag(tag *TagData) error {
+	if err := writeShardFile(s.filename(tag.Name), tag); err != nil {
+		return err
+	}
+	if s.index == nil {
+		return nil
+	}
+	info, err := os.Stat(s.filename(tag.Name))
+	if err != nil {
+		return err
+	}
+	s.index[tag.Name] = shardIndexEntryOf(tag, info)
+	return s.indexChanged()
+}
+
+func (s *shardStore) DeleteTag(name string) error {
+	err := os.Remove(s.filename(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.index == nil {
+		return nil
+	}
+	delete(s.index, name)
+	return s.indexChanged()
+}
+
+func (s *shardStore) ListTags() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		file := info.Name()
+		if info.IsDir() || !strings.HasSuffix(file, ".json") || strings.HasPrefix(file, ".") {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(file, ".json"))
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *shardStore) FilesOf(tag string) ([]string, error) {
+	data, err := s.GetTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(data.Files))
+	for file := range data.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *shardStore) TagsOf(file string) ([]string, error) {
+	index, err := s.FileIndex()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, index[file]...), nil
+}
+
+// ==================== index ====================
+
+func shardIndexEntryOf(tag *TagData, info os.FileInfo) *shardIndexEntry {
+	sum := summaryOf(tag)
+	entry := &shardIndexEntry{
+		Size:    info.Size(),
+		Mtime:   info.ModTime().UnixNano(),
+		Tags:    sum.Tags,
+		Query:   sum.Query,
+		Comment: sum.Comment,
+	}
+	for file := range tag.Files {
+		entry.Files = append(entry.Files, file)
+	}
+	sort.Strings(entry.Files)
+	return entry
+}
+
+// 索引を読み込む
+// git での更新などで変わったタグのファイルは読み直す
+func (s *shardStore) loadIndex() error {
+	if s.index != nil {
+		return nil
+	}
+	index := map[string]*shardIndexEntry{}
+	if b, err := ioutil.ReadFile(s.indexFile()); err == nil {
+		// 壊れている場合は作り直す
+		if json.Unmarshal(b, &index) != nil {
+			index = map[string]*shardIndexEntry{}
+		}
+	}
+	names, err := s.ListTags()
+	if err != nil {
+		return err
+	}
+	changed := len(index) != len(names)
+	valid := map[string]bool{}
+	for _, name := range names {
+		valid[name] = true
+		info, err := os.Stat(s.filename(name))
+		if err != nil {
+			return err
+		}
+		entry, ok := index[name]
+		if ok && entry.Size == info.Size() && entry.Mtime == info.ModTime().UnixNano() {
+			continue
+		}
+		tag, err := s.GetTag(name)
+		if err != nil {
+			return err
+		}
+		index[name] = shardIndexEntryOf(tag, info)
+		changed = true
+	}
+	for name := range index {
+		if !valid[name] {
+			delete(index, name)
+			changed = true
+		}
+	}
+	s.index = index
+	if changed {
+		return s.indexChanged()
+	}
+	return nil
+}
+
+func (s *shardStore) indexChanged() error {
+	s.fileTags = nil
+	if s.inTx {
+		s.indexDirty = true
+		return nil
+	}
+	return writeShardFile(s.indexFile(), s.index)
+}
+
+func (s *shardStore) FileIndex() (map[string][]string, error) {
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	if s.fileTags == nil {
+		s.fileTags = map[string][]string{}
+		for name, entry := range s.index {
+			for _, file := range entry.Files {
+				s.fileTags[file] = append(s.fileTags[file], name)
+			}
+		}
+		for _, tags := range s.fileTags {
+			sort.Strings(tags)
+		}
+	}
+	return s.fileTags, nil
+}
+
+func (s *shardStore) TagIndex() (map[string]TagSummary, error) {
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	index := map[string]TagSummary{}
+	for name, entry := range s.index {
+		index[name] = TagSummary{Tags: entry.Tags, Query: entry.Query, Comment: entry.Comment}
+	}
+	return index, nil
+}
+
+// ==================== file ====================
+
+// ファイル名のハッシュの先頭2文字ごとに分ける
+func metaShardName(file string) string {
+	h := sha256.Sum256([]byte(file))
+	return hex.EncodeToString(h[:1]) + ".json"
+}
+
+func (s *shardStore) loadMetas(name string) (*shardMetas, error) {
+	if m, ok := s.metas[name]; ok {
+		return m, nil
+	}
+	m := &shardMetas{
+		shared: map[string]map[string]json.RawMessage{},
+		local:  map[string]map[string]json.RawMessage{},
+	}
+	for _, v := range []struct {
+		file  string
+		metas map[string]map[string]json.RawMessage
+	}{{filepath.Join(s.filesDir, name), m.shared}, {filepath.Join(s.localDir, name), m.local}} {
+		b, err := ioutil.ReadFile(v.file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &v.metas); err != nil {
+			return nil, err
+		}
+	}
+	s.metas[name] = m
+	return m, nil
+}
+
+func (s *shardStore) GetFile(file string) (json.RawMessage, error) {
+	m, err := s.loadMetas(metaShardName(file))
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]json.RawMessage{}
+	for k, v := range m.local[file] {
+		meta[k] = v
+	}
+	for k, v := range m.shared[file] {
+		meta[k] = v
+	}
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(meta)
+}
+
+// 属性は共有し、それ以外はマシンごとのファイルに分けて保存する
+func (s *shardStore) PutFile(file string, meta json.RawMessage) error {
+	name := metaShardName(file)
+	m, err := s.loadMetas(name)
+	if err != nil {
+		return err
+	}
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return err
+	}
+	shared := map[string]json.RawMessage{}
+	local := map[string]json.RawMessage{}
+	for k, v := range entry {
+		if isLocalFileKey(k) {
+			local[k] = v
+		} else {
+			shared[k] = v
+		}
+	}
+	setMeta(m.shared, file, shared)
+	setMeta(m.local, file, local)
+	return s.metasChanged(m)
+}
+
+func setMeta(metas map[string]map[string]json.RawMessage, file string, meta map[string]json.RawMessage) {
+	if len(meta) == 0 {
+		delete(metas, file)
+		return
+	}
+	metas[file] = meta
+}
+
+func (s *shardStore) DeleteFile(file string) error {
+	name := metaShardName(file)
+	m, err := s.loadMetas(name)
+	if err != nil {
+		return err
+	}
+	delete(m.shared, file)
+	delete(m.local, file)
+	return s.metasChanged(m)
+}
+
+func (s *shardStore) metasChanged(m *shardMetas) error {
+	m.dirty = true
+	if s.inTx {
+		return nil
+	}
+	return s.flushMetas()
+}
+
+func (s *shardStore) flushMetas() error {
+	for name, m := range s.metas {
+		if !m.dirty {
+			continue
+		}
+		for _, v := range []struct {
+			file  string
+			metas map[string]map[string]json.RawMessage
+		}{{filepath.Join(s.filesDir, name), m.shared}, {filepath.Join(s.localDir, name), m.local}} {
+			if len(v.metas) == 0 {
+				if err := os.Remove(v.file); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				continue
+			}
+			if err := writeShardFile(v.file, v.metas); err != nil {
+				return err
+			}
+		}
+		m.dirty = false
+	}
+	return nil
+}
+
+func (s *shardStore) ListFiles() ([]string, error) {
+	names := map[string]bool{}
+	for _, dir := range []string{s.filesDir, s.localDir} {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") && !strings.HasPrefix(info.Name(), ".") {
+				names[info.Name()] = true
+			}
+		}
+	}
+	files := make([]string, 0)
+	for name := range names {
+		m, err := s.loadMetas(name)
+		if err != nil {
+			return nil, err
+		}
+		for file := range m.shared {
+			files = append(files, file)
+		}
+		for file := range m.local {
+			if _, ok := m.shared[file]; !ok {
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// 索引とファイルの情報は最後にまとめて書き込む
+func (s *shardStore) Tx(fn func(s Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	s.inTx = true
+	err := fn(s)
+	s.inTx = false
+	if err != nil {
+		return err
+	}
+	if s.indexDirty {
+		s.indexDirty = false
+		if err := writeShardFile(s.indexFile(), s.index); err != nil {
+			return err
+		}
+	}
+	return s.flushMetas()
+}
+
+func (s *shardStore) Close() error {
+	return nil
+}
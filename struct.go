@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
 
 	"github.com/intelfike/nestmap"
 )
@@ -16,87 +18,253 @@ type Tager struct {
 	// configFile string
 	config   *nestmap.Nestmap
 	rootTags *nestmap.Nestmap
+	// 計算中の論理式タグ(循環参照の検出用)
+	querying map[string]bool
+	// ファイル -> 登録されているタグ(tagsOf で必要になった分だけ作る)
+	fileIndex map[string][]string
+	// タグの保存先
+	store Store
+	// store から読み込んだタグ(変更の検出用)
+	storedTags map[string]string
+	// store にあり、まだ root.tags に読み込んでいないタグ
+	unloadedTags map[string]bool
+	// store の索引から読み込んだタグの概要(読み込んでいないタグの子タグや論理式)
+	tagSummaries map[string]TagSummary
+	// store から root.files に読み込んだファイルの情報(変更の検出用、store にない場合は "")
+	storedFiles map[string]string
+	// 読み込み時、保存時の設定(履歴の記録用)
+	snapshot []byte
+	// プロジェクト用の設定ファイルの場合のルートディレクトリ
+	projectRoot string
 }
 
 // ========== init ==========
 
-func (t *Tager) init() {
+func (t *Tager) init() error {
 	dir, _ := filepath.Split(configFile)
-	os.Mkdir(dir, 0777)
-	os.Create(configFile)
+	os.MkdirAll(dir, 0777)
 	t.rootTags.MakeMap()
-	t.saveConfig()
+	return t.saveConfig()
 }
 func (t *Tager) isInited() bool {
 	return fileExists(configFile)
 }
 
 // ========== config ==========
-func (t *Tager) readConfig(filename string) {
-	dir, _ := filepath.Split(filename)
-	// 設定ファイルの読み込み、なければつくるのみ
-	if _, err := os.Stat(dir); err != nil {
-		os.Mkdir(dir, 0777)
-		initFile()
-	}
-
+// mount --fuse や serve からも呼ばれるので、失敗しても終了せずにエラーを返す
+func (t *Tager) readConfig(filename string) error {
 	confb, err := ioutil.ReadFile(filename)
 	if err != nil {
-		initFile()
-		confb, _ = ioutil.ReadFile(filename)
+		// 設定ファイルがなければ空の設定とする(ファイルは tager init で作成する)
+		confb = []byte(`{"root":{"tags":{}}}`)
+	}
+	if err := t.setConfig(confb); err != nil {
+		return errors.New(filename + " を読み込めませんでした\n" + err.Error())
+	}
+	if t.store != nil {
+		t.store.Close()
+	}
+	if t.store, err = t.openStore(storeKind(t.config)); err != nil {
+		return err
+	}
+	if err := t.loadTags(); err != nil {
+		return err
 	}
+	t.resetFileIndex()
+	b, _ := t.config.BytesIndent()
+	t.snapshot, _ = t.storedBytes(b)
+	return nil
+}
 
+// 設定を置き換える
+func (t *Tager) setConfig(b []byte) error {
 	m := new(interface{})
-
-	err = json.Unmarshal(confb, &m)
-	if err != nil {
-		log.Fatalf("error: %v", err)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if t.projectRoot != "" {
+		if err := mergeLocalConfig(*m); err != nil {
+			return err
+		}
+		convertConfigPaths(*m, t.absPath)
 	}
 	t.config = nestmap.New()
 	t.config.Indent = "\t"
 	t.config.Set(*m)
 	t.rootTags = t.config.Child("root", "tags")
+	if !t.rootTags.Exists() {
+		t.rootTags.MakeMap()
+	}
+	t.resetFileIndex()
+	return nil
 }
 
+// ファイルからタグを逆引きするための索引を空にする
+// 索引は tagsOf で必要になったファイルの分だけ作り直す
+func (t *Tager) resetFileIndex() {
+	t.fileIndex = map[string][]string{}
+}
+
+// ファイルが登録されているタグ(論理式タグは含まない)
+// 読み込み済みのタグはメモリ上の内容を、それ以外は store の索引を使う
+func (t *Tager) tagsOf(full string) []string {
+	if tags, ok := t.fileIndex[full]; ok {
+		return tags
+	}
+	tags := make([]string, 0)
+	if len(t.unloadedTags) != 0 {
+		stored, err := t.store.TagsOf(t.relPath(full))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		for _, tag := range stored {
+			if !t.tagLoaded(tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, tag := range t.rootTags.Keys() {
+		if t.rootTags.HasChild(tag, "files", full) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	t.fileIndex[full] = tags
+	return tags
+}
+
+// どれかのタグに登録されているファイルか
+func (t *Tager) isRegistered(full string) bool {
+	return len(t.tagsOf(full)) != 0
+}
+
+// 設定を保存し、変更を履歴に記録する
 func (t *Tager) saveConfig() error {
 	b, err := t.config.BytesIndent()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(configFile, b, 0766)
+	if b, err = t.storedBytes(b); err != nil {
+		return err
+	}
+	// persist で storedTags が更新される前に、変更前の内容を作る
+	before, err := t.journalSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := t.persist(b); err != nil {
+		return err
+	}
+	if err := t.writeLocalConfig(); err != nil {
+		return err
+	}
+	if err := recordJournal(before, b); err != nil {
+		fmt.Fprintln(os.Stderr, "履歴の記録に失敗しました:", err)
+	}
+	t.snapshot = b
+	return nil
+}
+
+// 設定を保存する
+// json 以外の保存先では、タグとファイルの情報は store に、それ以外の設定は config.json に保存する
+func (t *Tager) persist(b []byte) error {
+	if _, ok := t.store.(*jsonStore); ok {
+		return writeConfigFile(b)
+	}
+	if err := t.syncTags(); err != nil {
+		return err
+	}
+	if err := t.syncFiles(); err != nil {
+		return err
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+	if root, ok := conf["root"].(map[string]interface{}); ok {
+		delete(root, "tags")
+		delete(root, "files")
+	}
+	b, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(b)
 }
 
 // ========== get ==========
+func validateTagName(tag string) error {
+	if tag == "" {
+		return errors.New("タグ名が空です")
+	}
+	if strings.ContainsAny(tag, "/") {
+		return errors.New(tag + " / はタグ名に利用できません")
+	}
+	if tag == "." {
+		return errors.New(". というタグ名は予約されています")
+	}
+	// 論理式(query.go)や属性の比較で区切りとして扱われる文字は使えない
+	if strings.ContainsAny(tag, "&|!()=<>") || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+		return errors.New(tag + " 空白と & | ! ( ) = < > はタグ名に利用できません")
+	}
+	switch tag {
+	case "AND", "OR", "NOT":
+		return errors.New(tag + " というタグ名は論理式の演算子として予約されています")
+	}
+	return nil
+}
+
 func (t *Tager) tagExists(tag string) bool {
 	_, err := t.getTag(tag)
 	return err == nil
 }
 func (t *Tager) getTag(tag string) (*nestmap.Nestmap, error) {
-	// カレントタグ用の前置処理
-	if tag == "." {
-		current := t.config.Child("root", "current")
-		if !current.Exists() {
-			return nil, errors.New(". を利用しましたが、カレントタグが未登録です\ntager ch -h を参照してください")
-		}
-		tag = current.ToString()
+	name, err := t.resolveTag(tag)
+	if err != nil {
+		return nil, err
 	}
-	// タグ呼び出し
-	cur := t.rootTags.Child(tag)
-	if !cur.Exists() {
-		return nil, errors.New(tag + " そのようなタグは存在しません")
+	return t.tagNode(name), nil
+}
+
+// タグ名を解決する
+// "." はカレントタグ、"a/b/c" は a から子タグを辿った c を表す
+func (t *Tager) resolveTag(tag string) (string, error) {
+	// 以前の版で作成された / を含むタグ名は、tager rename で変更できるようにそのまま扱う
+	if strings.Contains(tag, "/") && t.hasTag(tag) {
+		return tag, nil
 	}
-	return cur, nil
+	parent := ""
+	for n, name := range strings.Split(tag, "/") {
+		// カレントタグ用の前置処理
+		if name == "." && n == 0 {
+			current := t.config.Child("root", "current")
+			if !current.Exists() {
+				return "", errors.New(". を利用しましたが、カレントタグが未登録です\ntager ch -h を参照してください")
+			}
+			name = current.ToString()
+		}
+		// タグ呼び出し
+		if !t.hasTag(name) {
+			return "", errors.New(tag + " そのようなタグは存在しません")
+		}
+		if parent != "" && !t.tagNode(parent).HasChild("tags", name) {
+			return "", errors.New(tag + " " + name + " は " + parent + " の子タグではありません")
+		}
+		parent = name
+	}
+	return parent, nil
 }
 
-func (t *Tager) getChildTags(tag string) ([]string, error) {
+// recursive の場合は、子孫のタグを parent/child/grandchild の形式で返す
+func (t *Tager) getChildTags(tag string, recursive bool) ([]string, error) {
 	cur, err := t.getTag(tag)
 	if err != nil {
 		return nil, errors.New(tag + "そのようなタグは存在しません")
 	}
 	ss := make([]string, 0)
-	if *showFlagR {
-		recNestTag(cur, tag, func(nm *nestmap.Nestmap, path string) {
-			ss = append(ss, path+"/"+nm.BottomPath().(string))
+	if recursive {
+		t.tagGraph().walkPaths(cur.BottomPath().(string), func(child, path string) {
+			ss = append(ss, tag+"/"+path)
 		})
 	} else {
 		if cur.HasChild("tags") {
@@ -105,33 +273,150 @@ func (t *Tager) getChildTags(tag string) ([]string, error) {
 	}
 	return ss, nil
 }
-func (t *Tager) getFiles(tag string) ([]string, error) {
-	cur, err := t.getTag(tag)
+
+// recursive の場合は、子孫のタグのファイルも返す
+func (t *Tager) getFiles(tag string, recursive bool) ([]string, error) {
+	name, err := t.resolveTag(tag)
 	if err != nil {
 		return nil, errors.New(tag + "そのようなタグは存在しません")
 	}
+	files, err := t.directFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	if recursive {
+		for _, child := range t.tagGraph().descendants(name) {
+			fs, err := t.directFiles(child)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, fs...)
+		}
+	}
+	return files, nil
+}
+
+// 子タグを辿らずに、タグ自身のファイルを返す
+// 論理式タグの場合は論理式を計算する
+func (t *Tager) directFiles(tag string) ([]string, error) {
+	name, err := t.resolveTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	// 読み込んでいないタグは store から取得する
+	if !t.tagLoaded(name) && !t.isQueryTag(name) {
+		files, err := t.store.FilesOf(name)
+		if err != nil {
+			return nil, err
+		}
+		for n, file := range files {
+			files[n] = t.absPath(file)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	cur := t.tagNode(name)
+	if cur.HasChild("query") {
+		return t.evalQueryTag(cur.BottomPath().(string), cur.Child("query").ToString())
+	}
+	if !cur.HasChild("files") {
+		return []string{}, nil
+	}
+	return cur.Child("files").Keys(), nil
+}
+
+// 論理式の中のタグは、呼び出し元に関わらず子タグを辿らずに計算する
+func (t *Tager) evalQueryTag(tag, expr string) ([]string, error) {
+	if t.querying == nil {
+		t.querying = map[string]bool{}
+	}
+	if t.querying[tag] {
+		return nil, errors.New(tag + " :論理式タグが循環参照しています")
+	}
+	t.querying[tag] = true
+	defer delete(t.querying, tag)
+
+	node, err := parseQuery(expr)
+	if err != nil {
+		return nil, errors.New(tag + " の論理式が正しくありません\n" + err.Error())
+	}
+	return node.eval(t, false)
+}
+
+// すべてのタグに登録されているファイル
+// 読み込んでいないタグの分は store の索引から求める
+func (t *Tager) allFiles() []string {
 	files := make([]string, 0)
-	if cur.IsMap() {
-		if cur.HasChild("files") {
-			files = append(files, cur.Child("files").Keys()...)
-		}
-		if *showFlagR {
-			recNestTag(cur, "", func(nm *nestmap.Nestmap, path string) {
-				if !nm.HasChild("files") {
-					return
+	if len(t.unloadedTags) != 0 {
+		index, err := t.store.FileIndex()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		for file, tags := range index {
+			for _, tag := range tags {
+				if !t.tagLoaded(tag) {
+					files = append(files, t.absPath(file))
+					break
 				}
-				files = append(files, nm.Child("files").Keys()...)
-			})
+			}
 		}
 	}
-	return files, nil
+	for _, tag := range t.rootTags.Keys() {
+		files = append(files, t.childKeys(t.rootTags.Child(tag), "files")...)
+	}
+	return uniqueStrings(files...)
+}
+
+// ファイルが登録されているタグを返す
+// recursive の場合は、子タグを通してファイルに辿り着く祖先のタグも返す
+func (t *Tager) tagsOfFile(file string, recursive bool) ([]string, error) {
+	full, err := filepath.Abs(file)
+	if err != nil {
+		return nil, errors.New(file + " ファイル名の指定が正しくありません")
+	}
+	tags := make([]string, 0)
+	tags = append(tags, t.tagsOf(full)...)
+	// 論理式タグは索引に含まれないので計算する
+	for _, tag := range t.tagNames() {
+		if !t.isQueryTag(tag) {
+			continue
+		}
+		files, err := t.directFiles(tag)
+		if err != nil {
+			continue
+		}
+		for _, v := range files {
+			if v == full {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+	if recursive {
+		parents := t.parentIndex()
+		for n := 0; n < len(tags); n++ {
+			tags = uniqueStrings(append(tags, parents[tags[n]]...)...)
+		}
+	}
+	return uniqueStrings(tags...), nil
+}
+
+// 子タグ -> 親タグ
+func (t *Tager) parentIndex() map[string][]string {
+	parents := map[string][]string{}
+	for _, tag := range t.tagNames() {
+		for _, child := range t.childTagNames(tag) {
+			parents[child] = append(parents[child], tag)
+		}
+	}
+	return parents
 }
 
 // 複数のタグを指定した場合、AND計算をする
-func (t *Tager) getFilesAND(tags ...string) ([]string, error) {
+func (t *Tager) getFilesAND(recursive bool, tags ...string) ([]string, error) {
 	files := make([][]string, 0)
 	for _, v := range tags {
-		fs, err := t.getFiles(v)
+		fs, err := t.getFiles(v, recursive)
 		if err != nil {
 			return nil, errors.New(v + "そのようなタグは存在しません")
 		}
@@ -157,7 +442,10 @@ func (t *Tager) getFilesAND(tags ...string) ([]string, error) {
 func (t *Tager) tagAddFile(tag string, globs ...string) {
 	cur, err := t.getTag(tag)
 	if err != nil {
-		fmt.Println(err)
+		outputFatal(err)
+	}
+	if cur.HasChild("query") {
+		fmt.Println(tag, "は論理式タグなのでファイルを登録できません")
 		os.Exit(1)
 	}
 	for _, glob := range globs {
@@ -168,31 +456,507 @@ func (t *Tager) tagAddFile(tag string, globs ...string) {
 				fmt.Println(file, "というファイルは既に", tag, "に登録されています")
 				continue
 			}
-			cur.Child("files", full).Set(file)
+			if err := t.registerFile(cur, full, file); err != nil {
+				outputError(file, err)
+				continue
+			}
 		}
 	}
 }
 
+// タグにファイルを登録する
+// ディレクトリ(--include-dirs)は内容で同一性を判定できないので、ファイルの情報は記録しない
+func (t *Tager) registerFile(cur *nestmap.Nestmap, full, file string) error {
+	info, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := t.recordFile(full); err != nil {
+			return err
+		}
+	}
+	tags := t.tagsOf(full)
+	cur.Child("files", full).Set(file)
+	t.fileIndex[full] = append(tags, cur.BottomPath().(string))
+	return nil
+}
+
 // 再帰的にファイルを追加
-func (t *Tager) tagAddFileRec(tag string, globs ...string) {
-	filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			for n, glob := range globs {
-				globs[n] = path + "/" + glob
+// args はディレクトリかファイル名のパターン
+func (t *Tager) tagAddFileRec(tag string, opts walkOptions, args ...string) {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		outputFatal(err)
+	}
+	if cur.HasChild("query") {
+		fmt.Println(tag, "は論理式タグなのでファイルを登録できません")
+		os.Exit(1)
+	}
+	roots, patterns := splitWalkArgs(args)
+	added := 0
+	walkFiles(roots, patterns, opts, func(file string) {
+		full, _ := filepath.Abs(file)
+		if cur.HasChild("files") && cur.Child("files").HasChild(full) {
+			return
+		}
+		if err := t.registerFile(cur, full, file); err != nil {
+			outputError(file, err)
+			return
+		}
+		added++
+	})
+	fmt.Println(added, "個のファイルを", tag, "に登録しました")
+}
+
+// 再帰的にファイルの登録を解除
+func (t *Tager) tagRemoveFileRec(tag string, opts walkOptions, args ...string) {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		outputFatal(err)
+	}
+	tag = cur.BottomPath().(string)
+	roots, patterns := splitWalkArgs(args)
+	removed := 0
+	walkFiles(roots, patterns, opts, func(file string) {
+		full, _ := filepath.Abs(file)
+		if !containsString(t.tagsOf(full), tag) {
+			return
+		}
+		if err := t.unregisterFile(tag, full); err != nil {
+			outputError(file, err)
+			return
+		}
+		removed++
+	})
+	fmt.Println(removed, "個のファイルを", tag, "から登録解除しました")
+}
+
+// ========== edit ==========
+
+// タグを作成する
+func (t *Tager) createTag(tag string) error {
+	if err := validateTagName(tag); err != nil {
+		return err
+	}
+	if t.hasTag(tag) {
+		return errors.New(tag + " というタグは既に存在しています")
+	}
+	t.tagNode(tag).MakeMap()
+	return nil
+}
+
+// 論理式タグを作成する
+func (t *Tager) createQueryTag(tag, expr string) error {
+	if err := validateTagName(tag); err != nil {
+		return err
+	}
+	if t.hasTag(tag) {
+		return errors.New(tag + " というタグは既に存在しています")
+	}
+	if _, err := parseQuery(expr); err != nil {
+		return err
+	}
+	t.tagNode(tag).Child("query").Set(expr)
+	return nil
+}
+
+// "a/b/c" のようなタグを作成し、親タグに子タグとして登録する
+// parents の場合は mkdir -p のように途中のタグも作成し、既に存在していてもエラーにしない
+// expr が空でなければ、最後のタグを論理式タグとして作成する
+func (t *Tager) createTagPath(path, expr string, parents bool) error {
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if err := validateTagName(name); err != nil {
+			return err
+		}
+	}
+	last := len(names) - 1
+	for n, name := range names {
+		if n != last && !parents {
+			// 途中のタグは子タグとして辿れる必要がある
+			if _, err := t.resolveTag(strings.Join(names[:n+1], "/")); err != nil {
+				return err
+			}
+			continue
+		}
+		if !t.hasTag(name) {
+			var err error
+			if n == last && expr != "" {
+				err = t.createQueryTag(name, expr)
+			} else {
+				err = t.createTag(name)
+			}
+			if err != nil {
+				return err
 			}
-			t.tagAddFile(tag, globs...)
-			return nil
+		} else if n == last && !parents {
+			return errors.New(name + " というタグは既に存在しています")
 		}
+		if n == 0 {
+			continue
+		}
+		if t.tagNode(names[n-1]).HasChild("tags", name) {
+			continue
+		}
+		if err := t.addChildTag(names[n-1], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tager) deleteTag(tag string) error {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	files := t.childKeys(cur, "files")
+	cur.Remove()
+	t.resetFileIndex()
+	for _, file := range files {
+		t.forgetFile(file)
+	}
+	return nil
+}
+
+func (t *Tager) setComment(tag, comment string) error {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	cur.Child("comment").Set(comment)
+	return nil
+}
+
+// 子タグを登録する
+// 循環参照になる場合は登録しない
+func (t *Tager) addChildTag(tag, child string) error {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	tag = cur.BottomPath().(string)
+	childTag, err := t.getTag(child)
+	if err != nil {
+		return err
+	}
+	child = childTag.BottomPath().(string)
+	if tag == child {
+		return errors.New(child + " 登録元と登録先のタグが同じです")
+	}
+	if cycle := t.tagGraph().cycleIfAdded(tag, child); cycle != nil {
+		return errors.New(strings.Join(cycle, " -> ") + " :循環参照になるため登録できません")
+	}
+	cur.Child("tags", child).Set(child)
+	return nil
+}
+
+func (t *Tager) removeChildTag(tag, child string) error {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	if cur.HasChild("tags") {
+		cur.Child("tags", child).Remove()
+	}
+	return nil
+}
+
+// タグからファイルの登録を解除する
+func (t *Tager) unregisterFile(tag, full string) error {
+	cur, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	tag = cur.BottomPath().(string)
+	if !cur.HasChild("files") || !cur.Child("files").HasChild(full) {
 		return nil
-	})
+	}
+	tags := t.tagsOf(full)
+	cur.Child("files", full).Remove()
+	t.fileIndex[full] = subStrings(tags, []string{tag})
+	t.forgetFile(full)
+	return nil
+}
+
+// どのタグにも登録されていないファイルの情報(root.files)を削除する
+func (t *Tager) forgetFile(full string) {
+	if len(t.tagsOf(full)) != 0 {
+		return
+	}
+	delete(t.fileIndex, full)
+	t.fileMeta(full).Remove()
+}
+
+// ========== rename ==========
+
+// タグ名を変更し、他のタグからの参照もすべて書き換える
+func (t *Tager) renameTag(old, new string) error {
+	src, err := t.getTag(old)
+	if err != nil {
+		return err
+	}
+	old = src.BottomPath().(string)
+	if err := validateTagName(new); err != nil {
+		return err
+	}
+	if t.hasTag(new) {
+		return errors.New(new + " というタグは既に存在しています")
+	}
+	copyNode(src, t.tagNode(new))
+	src.Remove()
+	t.replaceTagRefs(old, new)
+	t.resetFileIndex()
+	return nil
+}
+
+// 複数のタグを dst に統合する
+// ファイル、子タグ、コメント、属性を dst に移動し、src は削除する
+// 同じ属性が dst にある場合は dst の値を残す
+func (t *Tager) mergeTags(srcs []string, dst string) error {
+	dstTag, err := t.getTag(dst)
+	if err != nil {
+		return err
+	}
+	dst = dstTag.BottomPath().(string)
+	if dstTag.HasChild("query") {
+		return errors.New(dst + " は論理式タグなので統合できません")
+	}
+	merged := map[string]bool{}
+	for n, src := range srcs {
+		cur, err := t.getTag(src)
+		if err != nil {
+			return err
+		}
+		src = cur.BottomPath().(string)
+		if src == dst {
+			return errors.New(src + " 統合元と統合先のタグが同じです")
+		}
+		if cur.HasChild("query") {
+			return errors.New(src + " は論理式タグなので統合できません")
+		}
+		srcs[n] = src
+		merged[src] = true
+	}
+
+	// 統合後の dst の子タグから dst (統合元を含む)へ辿れたら循環参照
+	merged[dst] = true
+	g := t.tagGraph()
+	for _, tag := range append(srcs, dst) {
+		for _, child := range t.childTagNames(tag) {
+			if merged[child] {
+				continue
+			}
+			if path := g.path(child, merged); path != nil {
+				return errors.New(strings.Join(append([]string{dst}, path...), " -> ") + " :循環参照になるため統合できません")
+			}
+		}
+	}
 
+	for _, src := range srcs {
+		cur := t.tagNode(src)
+		for _, file := range t.childKeys(cur, "files") {
+			if dstTag.Child("files").HasChild(file) {
+				continue
+			}
+			dstTag.Child("files", file).Set(cur.Child("files", file).ToString())
+		}
+		for _, child := range t.childKeys(cur, "tags") {
+			if merged[child] {
+				continue
+			}
+			dstTag.Child("tags", child).Set(child)
+		}
+		if cur.HasChild("comment") {
+			comment := cur.Child("comment").ToString()
+			if dstTag.HasChild("comment") {
+				comment = dstTag.Child("comment").ToString() + " / " + comment
+			}
+			dstTag.Child("comment").Set(comment)
+		}
+		copyAttrs(cur, dstTag)
+		cur.Remove()
+		t.replaceTagRefs(src, dst)
+	}
+	t.resetFileIndex()
+	return nil
+}
+
+// タグ old への参照(子タグ、論理式、カレントタグ、自動登録のルール、マウント、隔離領域)を new に置き換える
+func (t *Tager) replaceTagRefs(old, new string) {
+	for _, tag := range t.tagNames() {
+		// 書き換えるものがないタグは読み込まない
+		if !t.isQueryTag(tag) && !containsString(t.childTagNames(tag), old) {
+			continue
+		}
+		cur := t.tagNode(tag)
+		if cur.HasChild("query") {
+			query := cur.Child("query")
+			query.Set(renameQueryTag(query.ToString(), old, new))
+		}
+		if !cur.HasChild("tags") || !cur.Child("tags").HasChild(old) {
+			continue
+		}
+		cur.Child("tags", old).Remove()
+		if tag != new {
+			cur.Child("tags", new).Set(new)
+		}
+	}
+	current := t.config.Child("root", "current")
+	if current.Exists() && current.ToString() == old {
+		current.Set(new)
+	}
+	for _, name := range t.childKeys(t.config.Child("root"), "rules") {
+		if tag := t.config.Child("root", "rules", name, "tag"); tag.ToString() == old {
+			tag.Set(new)
+		}
+	}
+	t.renameMountTag(old, new)
+	t.renameQuarantineTag(old, new)
+}
+
+// src の属性のうち、dst にないものを dst にコピーする
+func copyAttrs(src, dst *nestmap.Nestmap) {
+	if !src.HasChild("attrs") {
+		return
+	}
+	for _, key := range src.Child("attrs").Keys() {
+		if dst.HasChild("attrs", key) {
+			continue
+		}
+		dst.Child("attrs", key).Set(src.Child("attrs", key).ToString())
+	}
+}
+
+func (t *Tager) childKeys(cur *nestmap.Nestmap, name string) []string {
+	if !cur.HasChild(name) {
+		return []string{}
+	}
+	return cur.Child(name).Keys()
+}
+
+// ========== copy ==========
+
+// src のファイルや子タグを dst にコピーする
+// 属性もコピーし、同じ属性が dst にある場合は dst の値を残す
+// dst が存在しない場合は作成する
+func (t *Tager) copyTag(src, dst string, files, tags bool) error {
+	srcTag, err := t.getTag(src)
+	if err != nil {
+		return err
+	}
+	src = srcTag.BottomPath().(string)
+	// 失敗したときに dst が作成されたまま残らないように、作成は最後に行う
+	dstTag, err := t.getTag(dst)
+	create := err != nil
+	if create {
+		if err := validateTagName(dst); err != nil {
+			return err
+		}
+	} else {
+		dst = dstTag.BottomPath().(string)
+	}
+	if src == dst {
+		return errors.New(src + " コピー元とコピー先のタグが同じです")
+	}
+	if srcTag.HasChild("query") || (!create && dstTag.HasChild("query")) {
+		return errors.New("論理式タグはコピーできません")
+	}
+	if tags {
+		// dst の子孫になるタグから dst に辿れたら循環参照
+		g := t.tagGraph()
+		for _, child := range t.childTagNames(src) {
+			if path := g.path(child, map[string]bool{dst: true}); path != nil {
+				return errors.New(strings.Join(append([]string{dst}, path...), " -> ") + " :循環参照になるためコピーできません")
+			}
+		}
+	}
+	if create {
+		dstTag = t.tagNode(dst)
+		dstTag.MakeMap()
+	}
+	if files {
+		for _, file := range t.childKeys(srcTag, "files") {
+			dstTag.Child("files", file).Set(srcTag.Child("files", file).ToString())
+		}
+	}
+	if tags {
+		for _, child := range t.childTagNames(src) {
+			dstTag.Child("tags", child).Set(child)
+		}
+	}
+	copyAttrs(srcTag, dstTag)
+	t.resetFileIndex()
+	return nil
+}
+
+// src から辿れるすべてのタグを、名前に prefix を付けた新しいタグとしてコピーする
+// src 自身のコピーは dst になる
+func (t *Tager) deepCopyTag(src, dst, prefix string) error {
+	srcTag, err := t.getTag(src)
+	if err != nil {
+		return err
+	}
+	src = srcTag.BottomPath().(string)
+	if prefix == "" {
+		return errors.New("--deep を指定した場合は --prefix も指定してください")
+	}
+
+	// コピー元のタグ名 -> 新しいタグ名
+	names := map[string]string{src: dst}
+	order := []string{src}
+	for _, child := range t.tagGraph().descendants(src) {
+		if _, ok := names[child]; ok {
+			continue
+		}
+		names[child] = prefix + child
+		order = append(order, child)
+	}
+	// 新しいタグ名が重なると、後からコピーしたタグで上書きされてしまう
+	copied := map[string]string{}
+	for _, tag := range order {
+		name := names[tag]
+		if err := validateTagName(name); err != nil {
+			return err
+		}
+		if t.hasTag(name) {
+			return errors.New(name + " というタグは既に存在しています")
+		}
+		if other, ok := copied[name]; ok {
+			return errors.New(name + " " + other + " と " + tag + " のコピー先が同じになります")
+		}
+		copied[name] = tag
+	}
+
+	for _, tag := range order {
+		cur := t.tagNode(tag)
+		newTag := t.tagNode(names[tag])
+		newTag.MakeMap()
+		// 子タグ以外(ファイル、コメント、論理式、属性など)はそのままコピーする
+		for _, key := range cur.Keys() {
+			if key != "tags" {
+				copyNode(cur.Child(key), newTag.Child(key))
+			}
+		}
+		for _, child := range t.childTagNames(tag) {
+			newTag.Child("tags", names[child]).Set(names[child])
+		}
+		// 論理式の中のコピーしたタグも、新しいタグ名にする
+		if newTag.HasChild("query") {
+			query := newTag.Child("query")
+			query.Set(renameQueryTags(query.ToString(), names))
+		}
+	}
+	t.resetFileIndex()
+	return nil
 }
 
 // ========== autoremove ==========
 
 func (t *Tager) autoremovableTags(tag string) ([]string, error) {
 	resultTags := make([]string, 0)
-	if tags, err := tager.getChildTags(tag); err == nil {
+	if tags, err := tager.getChildTags(tag, false); err == nil {
 		for _, v := range tags {
 			if _, err := tager.getTag(v); err == nil {
 				continue
@@ -206,15 +970,10 @@ func (t *Tager) autoremovableTags(tag string) ([]string, error) {
 }
 func (t *Tager) autoremovableFiles(tag string) ([]string, error) {
 	resultFiles := make([]string, 0)
-	if files, err := tager.getFiles(tag); err == nil {
-		for _, v := range files {
-			if !fileExists(v) {
-				continue
-			}
-			resultFiles = append(resultFiles, v)
-		}
-	} else {
+	cur, err := t.getTag(tag)
+	if err != nil {
 		return nil, errors.New(tag + "そのようなタグは存在しません")
 	}
+	resultFiles = append(resultFiles, t.brokenEntries(cur, "files")...)
 	return resultFiles, nil
 }
@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"os"
 
-	"github.com/intelfike/nestmap"
 	"github.com/spf13/cobra"
 )
 
@@ -15,58 +13,96 @@ var showTagsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			if *showFlagR {
-				fmt.Println("-r --recursive を指定した場合には表示するタグ名も入力してください")
+				outputFatal("-r --recursive を指定した場合には表示するタグ名も入力してください")
 				return
 			}
-			showTags(rootTags.Keys())
+			showTags(tager.tagNames())
 			return
 		}
-		ss, err := tager.getChildTags(args[0])
+		ss, err := tager.getChildTags(args[0], *showFlagR)
 		if err != nil {
-			fmt.Println(err)
+			outputFatal(err)
 			return
 		}
 		showTags(ss)
 	},
 }
 
+var showTagsOfCmd = &cobra.Command{
+	Use:   "tags-of [flags] FILE...",
+	Short: "ファイルが登録されているタグを一覧する",
+	Long:  "ファイルが登録されているタグを一覧する\n-r を指定した場合は、子タグを通してファイルに辿り着く祖先のタグも表示します",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			return
+		}
+		// file, name, comment, query
+		table := newTable(1, "file", "name", "comment", "query")
+		for n, file := range args {
+			tags, err := tager.tagsOfFile(file, *showFlagR)
+			if err != nil {
+				outputError(err)
+				continue
+			}
+			if !textOutput() {
+				for _, row := range tagTable(tags).rows {
+					table.add(append([]interface{}{file}, row...)...)
+				}
+				continue
+			}
+			if len(args) != 1 {
+				if n != 0 {
+					fmt.Println()
+				}
+				fmt.Println(file + ":")
+			}
+			showTags(tags)
+		}
+		if !textOutput() {
+			if err := table.print(); err != nil {
+				outputFatal(err)
+			}
+		}
+	},
+}
+
 // ==================== add ====================
 
 // 循環参照のチェックをだね
 var addTagsCmd = &cobra.Command{
 	Use:   "tag [flags] TAG TAGS...",
 	Short: "タグにタグを登録する",
-	Long:  "タグにタグを登録する\n登録先のタグ、登録するタグの両方が create されている必要があります",
+	Long:  "タグにタグを登録する\n登録先のタグ、登録するタグの両方が create されている必要があります\n登録できなかったタグがある場合は、他のタグを登録した上で失敗として終了します",
 	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) <= 1 {
+			cmd.Help()
+			return
+		}
 		cur, err := tager.getTag(args[0])
 		if err != nil {
-			fmt.Println(err)
-			return
+			outputFatal(err)
 		}
 		for _, v := range args[1:] {
-			if _, err := tager.getTag(v); err != nil {
-				fmt.Println(err)
+			child, err := tager.getTag(v)
+			if err != nil {
+				outputError(err)
 				continue
 			}
-			if args[0] == v {
-				fmt.Println(v, "登録元と登録先のタグが同じです")
+			v = child.BottomPath().(string)
+			if cur.BottomPath().(string) == v {
+				outputError(v, "登録元と登録先のタグが同じです")
 				continue
 			}
 			if cur.Child("tags").HasChild(v) {
 				fmt.Println(v, "というタグは既に", args[0], "に登録されています")
 				continue
 			}
-			cur.Child("tags", v).Set(v)
-		}
-		// 循環参照をチェックして拒否するため
-		recNestTag(cur, "", func(nm *nestmap.Nestmap, path string) {
-			s := nm.BottomPath().(string)
-			unique := args[0] != s
-			if !unique {
-				fmt.Println(s, ":循環参照です\n登録に失敗しました")
-				os.Exit(1)
+			// 循環参照になる場合は addChildTag が拒否する
+			if err := tager.addChildTag(cur.BottomPath().(string), v); err != nil {
+				outputError(err)
 			}
-		})
+		}
 	},
 }
 
@@ -83,15 +119,18 @@ var removeTagsCmd = &cobra.Command{
 		}
 		cur, err := tager.getTag(args[0])
 		if err != nil {
-			fmt.Println(err)
+			outputError(err)
 			return
 		}
 		for _, v := range args[1:] {
-			if _, err := tager.getTag(v); err != nil {
-				fmt.Println(err)
+			child, err := tager.getTag(v)
+			if err != nil {
+				outputError(err)
 				continue
 			}
-			cur.Child("tags", v).Remove()
+			if cur.HasChild("tags") {
+				cur.Child("tags", child.BottomPath().(string)).Remove()
+			}
 		}
 	},
 }
@@ -104,24 +143,8 @@ var autoremoveTagsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			// 引数がなければすべてが対象
-			args = rootTags.Keys()
-		}
-		for _, v := range args {
-			cur := rootTags.Child(v)
-			if !cur.Exists() {
-				fmt.Println(v, "そのようなタグはありません")
-				continue
-			}
-			if !cur.HasChild("tags") {
-				continue
-			}
-			for _, tag := range cur.Child("tags").Keys() {
-				if rootTags.HasChild(tag) {
-					continue
-				}
-				cur.Child("tags", tag).Remove()
-				fmt.Println(v, "から", tag, "というタグを削除しました")
-			}
+			args = tager.tagNames()
 		}
+		tager.autoremove("tags", args, autoremoveOptionsOfFlags())
 	},
 }
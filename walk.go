@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 探索しないディレクトリ
+var walkSkipDirs = []string{".git", ".tager"}
+
+// 無視するファイルの一覧
+// .gitignore と同じ書式
+var ignoreFiles = []string{".gitignore", ".tagerignore"}
+
+// 進捗を表示する間隔
+const walkProgressStep = 1000
+
+type walkOptions struct {
+	// 0 は無制限
+	maxDepth int
+	// シンボリックリンクのディレクトリを辿る(リンク先がファイルの場合は常に対象にする)
+	followSymlinks bool
+	includeDirs    bool
+}
+
+// ディレクトリを探索するもの
+type walker struct {
+	opts walkOptions
+	// ファイル名のパターン
+	// / を含むパターンは探索を始めたディレクトリからの相対パスと照合する
+	patterns []string
+	root     string
+	// 辿ったディレクトリの実体(シンボリックリンクの循環を防ぐ)
+	visited map[string]bool
+	count   int
+	// 辿らなかったシンボリックリンクのディレクトリの数
+	skippedLinks int
+	fn           func(path string)
+}
+
+// 引数をディレクトリやファイルと、ファイル名のパターンに分ける
+// 存在しない引数は、パターンとして扱う
+// ディレクトリが指定されなかった場合は、カレントディレクトリを探索する
+func splitWalkArgs(args []string) (roots, patterns []string) {
+	for _, arg := range args {
+		if pathExists(arg) {
+			roots = append(roots, arg)
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	return roots, patterns
+}
+
+// roots 以下のファイルのうち、patterns に一致するものについて fn を実行する
+// .gitignore と .tagerignore に一致するものは除く
+// roots より上のディレクトリにある ignore ファイルも、git やプロジェクトのルートまで読み込む
+func walkFiles(roots, patterns []string, opts walkOptions, fn func(path string)) {
+	w := &walker{opts: opts, patterns: patterns, visited: map[string]bool{}, fn: fn}
+	for _, root := range roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			outputError(err)
+			continue
+		}
+		if !info.IsDir() {
+			w.fn(root)
+			continue
+		}
+		w.root = root
+		w.walk(root, 0, parentIgnoreRules(root))
+	}
+	if w.count >= walkProgressStep {
+		fmt.Fprintln(os.Stderr)
+	}
+	if w.skippedLinks != 0 {
+		fmt.Fprintln(os.Stderr, w.skippedLinks, "個のシンボリックリンクのディレクトリを辿りませんでした(辿る場合は --follow-symlinks)")
+	}
+}
+
+func (w *walker) walk(dir string, depth int, ignores []ignoreRule) {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if w.visited[real] {
+			return
+		}
+		w.visited[real] = true
+	}
+	ignores = append(ignores, readIgnoreRules(dir)...)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		outputError(err)
+		return
+	}
+	for _, info := range infos {
+		p := filepath.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			// リンク切れは除く
+			target, err := os.Stat(p)
+			if err != nil {
+				continue
+			}
+			if target.IsDir() && !w.opts.followSymlinks {
+				w.skippedLinks++
+				continue
+			}
+			info = target
+		}
+		isDir := info.IsDir()
+		if isDir && containsString(walkSkipDirs, info.Name()) {
+			continue
+		}
+		if ignored(ignores, p, isDir) {
+			continue
+		}
+		w.progress()
+		if !isDir {
+			if w.match(p) {
+				w.fn(p)
+			}
+			continue
+		}
+		if w.opts.includeDirs && w.match(p) {
+			w.fn(p)
+		}
+		if w.opts.maxDepth == 0 || depth+1 < w.opts.maxDepth {
+			w.walk(p, depth+1, ignores)
+		}
+	}
+}
+
+func (w *walker) match(p string) bool {
+	if len(w.patterns) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil {
+		rel = p
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range w.patterns {
+		pattern = filepath.ToSlash(pattern)
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlobstar(strings.TrimPrefix(pattern, "/"), rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walker) progress() {
+	w.count++
+	if w.count%walkProgressStep == 0 {
+		fmt.Fprintf(os.Stderr, "\r%d 個のファイルを探索しました", w.count)
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ==================== ignore ====================
+
+// .gitignore の1行
+type ignoreRule struct {
+	// ignore ファイルのあるディレクトリ
+	base    string
+	pattern string
+	negate  bool
+	dirOnly bool
+	// / を含むパターンは base からの相対パスと照合する
+	anchored bool
+	// base が絶対パスの場合に、相対パスを絶対パスにするためのカレントディレクトリ
+	cwd string
+}
+
+func readIgnoreRules(dir string) []ignoreRule {
+	rules := make([]ignoreRule, 0)
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimRight(sc.Text(), " \t\r")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rule := ignoreRule{base: dir}
+			if strings.HasPrefix(line, "!") {
+				rule.negate = true
+				line = line[1:]
+			}
+			line = strings.TrimPrefix(line, `\`)
+			if strings.HasSuffix(line, "/") {
+				rule.dirOnly = true
+				line = strings.TrimRight(line, "/")
+			}
+			if strings.Contains(line, "/") {
+				rule.anchored = true
+				line = strings.TrimPrefix(line, "/")
+			}
+			if line == "" {
+				continue
+			}
+			rule.pattern = line
+			rules = append(rules, rule)
+		}
+		f.Close()
+	}
+	return rules
+}
+
+// dir より上のディレクトリにある ignore ファイルを、上から順に読み込む
+// .git か .tager のあるディレクトリまで遡り、見つからなければ読み込まない
+func parentIgnoreRules(dir string) []ignoreRule {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	cur := filepath.Join(cwd, dir)
+	if filepath.IsAbs(dir) {
+		cur = filepath.Clean(dir)
+	}
+	parents := make([]string, 0)
+	for !isWalkTop(cur) {
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			return nil
+		}
+		cur = parent
+		parents = append(parents, cur)
+	}
+	rules := make([]ignoreRule, 0)
+	for n := len(parents) - 1; n >= 0; n-- {
+		for _, rule := range readIgnoreRules(parents[n]) {
+			rule.cwd = cwd
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func isWalkTop(dir string) bool {
+	for _, name := range walkSkipDirs {
+		if pathExists(filepath.Join(dir, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 最後に一致した行に従う
+func ignored(rules []ignoreRule, p string, isDir bool) bool {
+	result := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.match(p) {
+			result = !rule.negate
+		}
+	}
+	return result
+}
+
+func (r ignoreRule) match(p string) bool {
+	// 上のディレクトリの ignore ファイルは絶対パスで読み込んでいる
+	if r.cwd != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(r.cwd, p)
+	}
+	rel, err := filepath.Rel(r.base, p)
+	// ..foo のような名前は base の下にある
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if !r.anchored {
+		return matchGlobstar(r.pattern, path.Base(rel))
+	}
+	return matchGlobstar(r.pattern, rel)
+}
+
+// ** を含むパターンと / 区切りのパスを照合する
+func matchGlobstar(pattern, name string) bool {
+	ps := strings.Split(pattern, "/")
+	ns := strings.Split(name, "/")
+	return matchSegments(ps, ns)
+}
+
+func matchSegments(ps, ns []string) bool {
+	for len(ps) != 0 {
+		if ps[0] == "**" {
+			for n := 0; n <= len(ns); n++ {
+				if matchSegments(ps[1:], ns[n:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(ns) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(ps[0], ns[0]); !ok {
+			return false
+		}
+		ps, ns = ps[1:], ns[1:]
+	}
+	return len(ns) == 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchGlobstar(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"cmd/*.go", "cmd/main.go", true},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "a/b/main.go", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "b/c", false},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/x/y/c", true},
+		{"a/**/c", "a/x/y/d", false},
+		{"vendor", "vendor/x", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlobstar(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlobstar(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	base := filepath.FromSlash("/p")
+	rules := []ignoreRule{
+		{base: base, pattern: "*.log"},
+		{base: base, pattern: "keep.log", negate: true},
+		{base: base, pattern: "build", dirOnly: true},
+		{base: base, pattern: "docs/*.md", anchored: true},
+		{base: base, pattern: "gen/**/*.pb.go", anchored: true},
+		{base: filepath.Join(base, "sub"), pattern: "*.tmp"},
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"/p/a.log", false, true},
+		{"/p/x/y/a.log", false, true},
+		// 後の ! で除外しない
+		{"/p/keep.log", false, false},
+		{"/p/x/keep.log", false, false},
+		// / で終わるパターンはディレクトリのみ
+		{"/p/build", true, true},
+		{"/p/build", false, false},
+		{"/p/x/build", true, true},
+		// / を含むパターンは base からの相対パス
+		{"/p/docs/a.md", false, true},
+		{"/p/x/docs/a.md", false, false},
+		{"/p/docs/x/a.md", false, false},
+		{"/p/gen/a.pb.go", false, true},
+		{"/p/gen/x/y/a.pb.go", false, true},
+		{"/p/gen/x/a.go", false, false},
+		// 下のディレクトリの ignore ファイルは、そのディレクトリの中だけ
+		{"/p/sub/a.tmp", false, true},
+		{"/p/a.tmp", false, false},
+		{"/p/subdir/a.tmp", false, false},
+		// base の外は照合しない、..foo は base の中
+		{"/q/a.log", false, false},
+		{"/p/..a.log", false, true},
+	}
+	for _, tt := range tests {
+		if got := ignored(rules, filepath.FromSlash(tt.path), tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// 上のディレクトリの ignore ファイルは、.git のあるディレクトリまで読み込む
+func TestParentIgnoreRules(t *testing.T) {
+	top := t.TempDir()
+	for _, dir := range []string{".git", "a/b"} {
+		if err := os.MkdirAll(filepath.Join(top, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		".gitignore":     "*.log\n!keep.log\n",
+		"a/.tagerignore": "/b/*.tmp\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(top, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// top より上の ignore ファイルは読み込まない
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(top), ".gitignore"), []byte("*\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(top, "a", "b")
+	rules := parentIgnoreRules(root)
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"x.log", true},
+		{"keep.log", false},
+		{"x.tmp", true},
+		{"x.go", false},
+	}
+	for _, tt := range tests {
+		if got := ignored(rules, filepath.Join(root, tt.name), false); got != tt.want {
+			t.Errorf("ignored(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
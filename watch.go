@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [flags] [DIR...]",
+	Short: "ファイルの移動や削除を監視してタグを更新する",
+	Long: `ファイルの移動や削除を監視してタグを更新する
+登録されているファイルが移動された場合は、すべてのタグで新しいパスに付け替えます
+削除された場合は、削除済みとして記録します
+
+DIR を指定した場合は DIR 以下も監視し、新しく作成されたファイルに --rule と
+tager rule で登録されたルールを適用します
+例: tager watch --rule '*.go=golang' --rule '*_test.go=test' ~/src`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, err := parseWatchRules(*watchFlagRule)
+		if err != nil {
+			outputFatal(err)
+		}
+		for _, rule := range rules {
+			if !tager.tagExists(rule.tag) {
+				fmt.Println(rule.tag, "そのようなタグは存在しません")
+				os.Exit(1)
+			}
+		}
+		// 他のコマンドが実行できるように、ロックと保存先は変更のたびに取得する
+		tager.closeStore()
+		unlockConfig()
+		if err := tager.watch(args, rules); err != nil {
+			outputFatal(err)
+		}
+	},
+}
+
+// 新しく作成されたファイルに適用するタグ付けのルール
+type watchRule struct {
+	pattern string
+	tag     string
+}
+
+func parseWatchRules(ss []string) ([]watchRule, error) {
+	rules := make([]watchRule, 0)
+	for _, s := range ss {
+		n := strings.LastIndex(s, "=")
+		if n <= 0 || n == len(s)-1 {
+			return nil, errors.New(s + " ルールは PATTERN=TAG の形式で指定してください")
+		}
+		rule := watchRule{s[:n], s[n+1:]}
+		if _, err := filepath.Match(rule.pattern, ""); err != nil {
+			return nil, errors.New(s + " " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+const (
+	watchCreated = iota
+	watchMoved
+	watchDeleted
+)
+
+type watchEvent struct {
+	op      int
+	path    string
+	newPath string
+	isDir   bool
+}
+
+// 監視するディレクトリ
+// 登録されているファイルの親ディレクトリと、roots 以下のすべてのディレクトリ
+func (t *Tager) watchDirs(roots []string) ([]string, error) {
+	dirs, err := t.reloadFileDirs()
+	if err != nil {
+		return nil, err
+	}
+	return uniqueStrings(append(dirs, walkDirs(roots)...)...), nil
+}
+
+// 登録されているファイルの親ディレクトリ
+func (t *Tager) fileDirs() []string {
+	dirs := make([]string, 0)
+	for _, file := range t.allFiles() {
+		dirs = append(dirs, filepath.Dir(file))
+	}
+	return uniqueStrings(dirs...)
+}
+
+// roots 以下のすべてのディレクトリ(.git と .tager は除く)
+func walkDirs(roots []string) []string {
+	dirs := make([]string, 0)
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if path != root && containsString(walkSkipDirs, info.Name()) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		})
+	}
+	return dirs
+}
+
+// 設定を読み直して、登録されているファイルの親ディレクトリを返す
+// 他のコマンドで新しく登録されたファイルも監視するために使う
+func (t *Tager) reloadFileDirs() ([]string, error) {
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer t.closeStore()
+	if err := t.readConfig(configFile); err != nil {
+		return nil, err
+	}
+	return t.fileDirs(), nil
+}
+
+// 設定ファイルをロックして読み直し、f の変更を保存する
+func (t *Tager) update(f func() error) error {
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer t.closeStore()
+	if err := t.readConfig(configFile); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	return t.saveConfig()
+}
+
+func (t *Tager) applyWatchEvents(events []watchEvent, roots []string, rules []watchRule) error {
+	return t.update(func() error {
+		for _, ev := range events {
+			switch ev.op {
+			case watchMoved:
+				t.watchMove(ev)
+			case watchDeleted:
+				t.watchDeleted(ev)
+			case watchCreated:
+				t.watchRestored(ev.path)
+				if !ev.isDir && underDirs(ev.path, roots) {
+					t.applyWatchRules(ev.path, rules)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (t *Tager) watchMove(ev watchEvent) {
+	// 一時ファイルを登録ファイルの名前に移動して保存するエディタもある
+	t.watchRestored(ev.newPath)
+	if !ev.isDir {
+		if t.isRegistered(ev.path) {
+			t.moveFile(ev.path, ev.newPath)
+			fmt.Println("moved:", ev.path, "->", ev.newPath)
+		}
+		return
+	}
+	// ディレクトリ以下の登録ファイルをすべて付け替える
+	prefix := ev.path + string(filepath.Separator)
+	for _, file := range t.allFiles() {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		newFile := filepath.Join(ev.newPath, strings.TrimPrefix(file, prefix))
+		t.moveFile(file, newFile)
+		fmt.Println("moved:", file, "->", newFile)
+	}
+}
+
+// 登録ファイルを削除済みとして記録する
+// ディレクトリの場合は、その下の登録ファイルをすべて記録する
+func (t *Tager) watchDeleted(ev watchEvent) {
+	files := []string{ev.path}
+	if ev.isDir {
+		files = make([]string, 0)
+		prefix := ev.path + string(filepath.Separator)
+		for _, file := range t.allFiles() {
+			if strings.HasPrefix(file, prefix) {
+				files = append(files, file)
+			}
+		}
+	}
+	for _, file := range files {
+		// 先に記録した日時を残す
+		if !t.isRegistered(file) || t.fileMeta(file).HasChild("deleted") {
+			continue
+		}
+		t.fileMeta(file).Child("deleted").Set(time.Now().Format(time.RFC3339))
+		fmt.Println("deleted:", file)
+	}
+}
+
+// 削除済みとして記録した登録ファイルが作り直された場合は、記録を取り消す
+func (t *Tager) watchRestored(path string) {
+	if !t.isRegistered(path) {
+		return
+	}
+	if t.fileMeta(path).HasChild("deleted") {
+		t.fileMeta(path).Child("deleted").Remove()
+		fmt.Println("restored:", path)
+	}
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		if err := t.recordFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, path, err)
+		}
+	}
+}
+
+// エディタが保存時に作るバックアップなどの名前
+// 登録ファイルがこれらに移動された場合は、付け替えずに削除として扱う
+func isBackupName(path string) bool {
+	base := filepath.Base(path)
+	if strings.HasSuffix(base, "~") || strings.HasPrefix(base, ".#") ||
+		(strings.HasPrefix(base, "#") && strings.HasSuffix(base, "#")) {
+		return true
+	}
+	switch filepath.Ext(base) {
+	case ".bak", ".orig", ".swp", ".swx", ".tmp":
+		return true
+	}
+	return ignored(readIgnoreRules(filepath.Dir(path)), path, false)
+}
+
+func (t *Tager) applyWatchRules(path string, rules []watchRule) {
+	base := filepath.Base(path)
+	for _, rule := range rules {
+		if ok, _ := filepath.Match(rule.pattern, base); !ok {
+			continue
+		}
+		cur, err := t.getTag(rule.tag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if cur.Child("files").HasChild(path) {
+			continue
+		}
+		if err := t.registerFile(cur, path, path); err != nil {
+			fmt.Fprintln(os.Stderr, path, err)
+			continue
+		}
+		fmt.Println("added:", rule.tag, path)
+	}
+	// tager rule で登録されたルール
+	autoRules, err := t.autoRules()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	for _, m := range t.applyAutoRules(path, "", autoRules, false) {
+		if m.err != nil {
+			fmt.Fprintln(os.Stderr, path, m.err)
+			continue
+		}
+		if m.added {
+			fmt.Println("added:", m.rule.tag, path, "("+m.rule.name+")")
+		}
+	}
+}
+
+func underDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
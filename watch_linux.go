@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// 設定ファイルのディレクトリの監視
+// 他のコマンドが保存すると、config.json の置き換えか、journal.json などへの書き込みが起きる
+const watchConfigMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// 変更されたら設定を読み直すファイル
+// ロックファイルは読み直すたびに開くので含めない
+func watchConfigNames() []string {
+	return []string{filepath.Base(configFile), filepath.Base(localConfigFile()), filepath.Base(journalFile())}
+}
+
+// inotify でファイルの変更を監視する
+func (t *Tager) watch(roots []string, rules []watchRule) error {
+	for n, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		roots[n] = abs
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// watch descriptor -> ディレクトリ
+	// 同じディレクトリを設定ファイルの監視と兼ねることがあるので、IN_MASK_ADD で追加する
+	wds := map[int32]string{}
+	add := func(dir string) {
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask|syscall.IN_MASK_ADD)
+		if err != nil {
+			return
+		}
+		wds[int32(wd)] = dir
+	}
+	dirs, err := t.watchDirs(roots)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		add(dir)
+	}
+	fmt.Println(len(wds), "個のディレクトリを監視しています")
+	configWd, err := syscall.InotifyAddWatch(fd, filepath.Dir(configFile), watchConfigMask|syscall.IN_MASK_ADD)
+	if err != nil {
+		return err
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	ready := make([]syscall.EpollEvent, 1)
+	// cookie -> 確定していない移動
+	// MOVED_FROM と MOVED_TO が別の read に分かれることがあり、
+	// エディタは保存時に元のファイルを移動してから同じ名前で作り直すので、少し待ってから確定する
+	pending := map[uint32]*pendingMove{}
+	for {
+		timeout := -1
+		if len(pending) != 0 {
+			timeout = int(watchMoveWait / time.Millisecond)
+		}
+		nready, err := syscall.EpollWait(epfd, ready, timeout)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		events := make([]watchEvent, 0)
+		// 設定が変わったら、新しく登録されたファイルのディレクトリも監視する
+		reload := false
+		if nready != 0 {
+			n, err := syscall.Read(fd, buf)
+			if err != nil && err != syscall.EINTR && err != syscall.EAGAIN {
+				return err
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameStart := off + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+				off = nameStart + int(raw.Len)
+
+				if raw.Wd == int32(configWd) && containsString(watchConfigNames(), name) {
+					reload = true
+				}
+				dir, ok := wds[raw.Wd]
+				if !ok {
+					continue
+				}
+				switch {
+				case raw.Mask&syscall.IN_IGNORED != 0:
+					// 削除されたディレクトリの監視は自動で解除される
+					delete(wds, raw.Wd)
+					continue
+				case raw.Mask&syscall.IN_DELETE_SELF != 0:
+					events = append(events, watchEvent{watchDeleted, dir, "", true})
+					continue
+				case raw.Mask&syscall.IN_MOVE_SELF != 0:
+					// 監視中の親ディレクトリ内での移動は MOVED_FROM と MOVED_TO で扱う
+					// 監視外へ移動された場合は、その下のファイルは削除されたものとする
+					if !movingDir(pending, dir) {
+						events = append(events, watchEvent{watchDeleted, dir, "", true})
+						syscall.InotifyRmWatch(fd, uint32(raw.Wd))
+						delete(wds, raw.Wd)
+					}
+					continue
+				}
+				if name == "" {
+					continue
+				}
+				path := filepath.Join(dir, name)
+				isDir := raw.Mask&syscall.IN_ISDIR != 0
+				switch {
+				case raw.Mask&syscall.IN_MOVED_FROM != 0:
+					pending[raw.Cookie] = &pendingMove{from: path, isDir: isDir, at: time.Now()}
+				case raw.Mask&syscall.IN_MOVED_TO != 0:
+					cancelMoves(pending, path)
+					m, ok := pending[raw.Cookie]
+					if !ok {
+						events = append(events, watchEvent{watchCreated, path, "", isDir})
+						if isDir && underDirs(path, roots) {
+							for _, d := range walkDirs([]string{path}) {
+								add(d)
+							}
+						}
+						break
+					}
+					m.to = path
+					m.at = time.Now()
+					// 監視中のディレクトリのパスも付け替える
+					for wd, d := range wds {
+						if d == m.from || strings.HasPrefix(d, m.from+"/") {
+							wds[wd] = path + strings.TrimPrefix(d, m.from)
+						}
+					}
+					if !isDir {
+						add(filepath.Dir(path))
+					}
+				case raw.Mask&syscall.IN_DELETE != 0:
+					events = append(events, watchEvent{watchDeleted, path, "", isDir})
+				case raw.Mask&syscall.IN_CREATE != 0:
+					cancelMoves(pending, path)
+					events = append(events, watchEvent{watchCreated, path, "", isDir})
+					if isDir && underDirs(path, roots) {
+						for _, d := range walkDirs([]string{path}) {
+							add(d)
+						}
+					}
+				}
+			}
+		}
+		for _, ev := range flushMoves(pending, time.Now()) {
+			// 監視外へ移動されたディレクトリの監視をやめる
+			if ev.op == watchDeleted && ev.isDir {
+				for wd, d := range wds {
+					if d == ev.path || strings.HasPrefix(d, ev.path+"/") {
+						syscall.InotifyRmWatch(fd, uint32(wd))
+						delete(wds, wd)
+					}
+				}
+			}
+			events = append(events, ev)
+		}
+		if len(events) != 0 {
+			if err := t.applyWatchEvents(events, roots, rules); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			reload = true
+		}
+		if !reload {
+			continue
+		}
+		dirs, err := t.reloadFileDirs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		for _, dir := range dirs {
+			add(dir)
+		}
+	}
+}
+
+// dir が監視中のディレクトリ内で移動されている途中か
+// MOVE_SELF は MOVED_FROM, MOVED_TO の後に届くので、移動先のパスになっていることもある
+func movingDir(pending map[uint32]*pendingMove, dir string) bool {
+	for _, m := range pending {
+		if m.isDir && (m.from == dir || m.to == dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// 移動を確定するまで待つ時間
+const watchMoveWait = 500 * time.Millisecond
+
+type pendingMove struct {
+	from, to string
+	isDir    bool
+	at       time.Time
+}
+
+// 移動元と同じパスが作り直された場合は、移動ではなく上書き保存として扱う
+func cancelMoves(pending map[uint32]*pendingMove, path string) {
+	for cookie, m := range pending {
+		if m.from == path && m.to != "" {
+			delete(pending, cookie)
+		}
+	}
+}
+
+// 待ち時間を過ぎた移動を確定する
+// 監視外やバックアップファイルへの移動は削除として扱う
+func flushMoves(pending map[uint32]*pendingMove, now time.Time) []watchEvent {
+	events := make([]watchEvent, 0)
+	for cookie, m := range pending {
+		if now.Sub(m.at) < watchMoveWait {
+			continue
+		}
+		delete(pending, cookie)
+		if m.to == "" || (!m.isDir && isBackupName(m.to)) {
+			events = append(events, watchEvent{watchDeleted, m.from, "", m.isDir})
+			continue
+		}
+		events = append(events, watchEvent{watchMoved, m.from, m.to, m.isDir})
+	}
+	return events
+}
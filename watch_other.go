@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func (t *Tager) watch(roots []string, rules []watchRule) error {
+	return errors.New("watch は Linux でのみ利用できます")
+}